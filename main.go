@@ -8,18 +8,57 @@ import (
     "os/signal"
     "runtime"
     "runtime/pprof"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
     "syscall"
     "time"
 
     // internal
+    "afpacket"
+    "capture"
     "clock"
     "data"
     "dump"
     "pcap"
+    "replay"
 )
 
 var CONFIG map[string]string
 
+// one goroutine reads each capture source
+type reader struct {
+    id      int
+    source  capture.PacketSource
+    closing sync.Once // closed at the end of the reading or on CTRL-C
+    count   uint64    // atomic, shown in debug mode
+}
+
+var READERS []*reader
+
+// the parsers still running, waited for before the final dump
+var PARSERS sync.WaitGroup
+
+// the source of -generate, nil otherwise
+var GENERATOR *capture.Generator
+
+// -i may be repeated, or list several devices separated by commas
+type deviceList []string
+
+func (list *deviceList) String() string {
+    return strings.Join(*list, ",")
+}
+
+func (list *deviceList) Set(value string) error {
+    for _, device := range strings.Split(value, ",") {
+        if device != "" {
+            *list = append(*list, device)
+        }
+    }
+    return nil
+}
+
 func main() {
     CONFIG = get_opts()
     if CONFIG["listdevice"] == "true" {
@@ -28,21 +67,38 @@ func main() {
     }
     if CONFIG["profile"] == "true" {
         active_profiling()
+        defer write_allocs_profile()
         defer pprof.StopCPUProfile()
     }
 
     if CONFIG["debug"] == "true" {
         fmt.Printf("pcap version: %s\n", pcap.Version())
         fmt.Printf("Go version: %s\n", runtime.Version())
+        if CONFIG["expr"] != "" {
+            fmt.Printf("filter: %s\n", CONFIG["expr"])
+        }
+    }
+
+    if CONFIG["replay"] != "" {
+        replay_file()
+        return
     }
 
     init_maps()
-    pcapreader := create_reader()
+    init_sampler()
+    for id, source := range create_readers() {
+        READERS = append(READERS, &reader{id: id, source: source})
+    }
     quit_chan := make(chan bool)
+    if CONFIG["debug"] == "true" {
+        linktype := READERS[0].source.LinkType()
+        fmt.Printf("link type: %d %s\n", linktype, pcap.DatalinkValueToName(linktype))
+        fmt.Printf("readers: %d\n", len(READERS))
+    }
 
-    go signalCatcher(pcapreader)
-    go readPackets(pcapreader, quit_chan)
-    controler(pcapreader, quit_chan)
+    go signalCatcher()
+    go readAll(quit_chan)
+    controler(quit_chan)
 }
 
 func init_maps() {
@@ -51,33 +107,140 @@ func init_maps() {
     data.ETHMAP.Init(seconds_60)
     data.IPv4MAP = new(data.PMap)
     data.IPv4MAP.Init(seconds_60)
+    data.IPv6MAP = new(data.PMap)
+    data.IPv6MAP.Init(seconds_60)
     data.TcpMAP = new(data.PMap)
     data.TcpMAP.Init(seconds_60)
+    data.UdpMAP = new(data.PMap)
+    data.UdpMAP.Init(seconds_60)
+    data.IcmpMAP = new(data.PMap)
+    data.IcmpMAP.Init(seconds_60)
+    data.VlanMAP = new(data.PMap)
+    data.VlanMAP.Init(seconds_60)
+    data.ARPTABLE = data.NewArpTable()
     clock.InitClock()
 }
 
+func init_sampler() {
+    sampler, err := data.NewSampler(CONFIG)
+    if err != nil {
+        fmt.Printf("usage: %s\n", err)
+        os.Exit(3)
+    }
+    data.SAMPLER = sampler
+    maxparsers, _ := strconv.Atoi(CONFIG["maxparsers"])
+    data.SHEDDER = data.NewShedder(maxparsers, CONFIG["device"] != "")
+}
+
 func get_opts() map[string]string {
     config := make(map[string]string)
 
-    var device, filename, expr, dumpproto string
-    var listdevice, profile, debug bool
+    var devices deviceList
+    var filename, expr, dumpproto, write, writefilter, tstamp, backend string
+    var start, end, duration string
+    var blocksize, blocks, fanout, count, sample, maxparsers int
+    var snaplen, timeout, buffer int
+    var promisc, immediate bool
+    var direction string
+    var flowsample float64
+    var generate, genconc, gensize, genrate, genseed int
+    var replayto, rewrite string
+    var speed, pps, mbps float64
+    var loop int
+    var listdevice, profile, debug, native bool
 
-    flag.StringVar(&device, "i", "", "network interface")
+    flag.Var(&devices, "i", "network interface, repeated or comma separated to merge several")
     flag.StringVar(&filename, "r", "", "input pcap file")
     flag.StringVar(&expr, "e", "", "filter expression")
-    flag.StringVar(&dumpproto, "p", "tcp", "protocols to dump")
+    flag.StringVar(&replayto, "replay", "", "send the -r packets on this interface instead of reading them")
+    flag.Float64Var(&speed, "speed", 1, "replay: multiplier of the capture timing, 0 for top speed")
+    flag.Float64Var(&pps, "pps", 0, "replay: fixed packets per second")
+    flag.Float64Var(&mbps, "mbps", 0, "replay: fixed megabits per second")
+    flag.IntVar(&loop, "loop", 1, "replay: times the capture is sent, 0 for ever")
+    flag.StringVar(&rewrite, "rewrite", "", "replay: old=new MAC or IPv4 addresses, comma separated")
+    flag.IntVar(&generate, "generate", 0, "generate this number of TCP flows instead of reading")
+    flag.IntVar(&genconc, "genconc", 100, "generator: flows at a time")
+    flag.IntVar(&gensize, "gensize", 20000, "generator: average response size in bytes")
+    flag.IntVar(&genrate, "genrate", 0, "generator: packets per second, 0 for as fast as possible")
+    flag.IntVar(&genseed, "genseed", 1, "generator: random seed, the same seed gives the same traffic")
+    flag.StringVar(&backend, "backend", "libpcap", "live capture backend: libpcap or afpacket")
+    flag.IntVar(&snaplen, "snaplen", 65535, "bytes captured per packet")
+    flag.BoolVar(&promisc, "promisc", true, "promiscuous mode")
+    flag.IntVar(&timeout, "timeout", 0, "read timeout in ms, 0 for the backend default (libpcap 1000, afpacket 100)")
+    flag.IntVar(&buffer, "buffer", 0, "libpcap: kernel buffer size in bytes, 0 for the default")
+    flag.BoolVar(&immediate, "immediate", false, "libpcap: deliver the packets as they arrive")
+    flag.StringVar(&direction, "direction", "inout", "libpcap: capture direction, in, out or inout")
+    flag.IntVar(&blocksize, "blocksize", 1<<20, "afpacket: ring block size in bytes")
+    flag.IntVar(&blocks, "blocks", 64, "afpacket: number of ring blocks")
+    flag.IntVar(&fanout, "fanout", 1, "afpacket: number of sockets and readers in a fanout group")
+    flag.StringVar(&start, "start", "", "skip the packets before: +10m from the first packet, unix seconds or RFC 3339")
+    flag.StringVar(&end, "end", "", "stop at: +10m from the first packet, unix seconds or RFC 3339")
+    flag.StringVar(&duration, "duration", "", "stop after this duration from the start, 10m")
+    flag.IntVar(&count, "c", 0, "stop after this number of packets")
+    flag.IntVar(&sample, "sample", 1, "only parse 1 packet in N")
+    flag.Float64Var(&flowsample, "flowsample", 1, "only parse this fraction of the flows, kept whole")
+    flag.IntVar(&maxparsers, "maxparsers", 10000, "parsers in flight before shedding load, 0 for no limit")
+    flag.StringVar(&write, "w", "", "write the read packets to a pcap file")
+    flag.StringVar(&writefilter, "wf", "", "only write packets matching this filter (expression, ip|ip or ip|ip|port|port)")
+    flag.StringVar(&dumpproto, "p", "tcp", "protocols to dump, comma separated: eth, ip, ipv6, tcp, udp, icmp, arp, vlan")
+    flag.StringVar(&tstamp, "tstamp", "micro", "timestamp precision: micro or nano")
     flag.BoolVar(&listdevice, "l", false, "just list devices and exit")
+    flag.BoolVar(&native, "native", false, "read the pcap file without libpcap")
     flag.BoolVar(&debug, "d", false, "debug mode")
     flag.BoolVar(&profile, "profile", false, "activate profiling")
     flag.Parse()
+    if backend != "libpcap" && backend != "afpacket" {
+        fmt.Printf("bad -backend %s: libpcap or afpacket\n", backend)
+        os.Exit(3)
+    }
+    if direction != "in" && direction != "out" && direction != "inout" {
+        fmt.Printf("bad -direction %s: in, out or inout\n", direction)
+        os.Exit(3)
+    }
+    if tstamp != "micro" && tstamp != "nano" {
+        fmt.Printf("bad -tstamp %s: micro or nano\n", tstamp)
+        os.Exit(3)
+    }
 
     config["debug"] = fmt.Sprintf("%t", debug)
-    config["device"] = device
+    config["device"] = devices.String()
+    config["backend"] = backend
+    config["snaplen"] = fmt.Sprintf("%d", snaplen)
+    config["promisc"] = fmt.Sprintf("%t", promisc)
+    config["timeout"] = fmt.Sprintf("%d", timeout)
+    config["buffer"] = fmt.Sprintf("%d", buffer)
+    config["immediate"] = fmt.Sprintf("%t", immediate)
+    config["direction"] = direction
+    config["blocksize"] = fmt.Sprintf("%d", blocksize)
+    config["blocks"] = fmt.Sprintf("%d", blocks)
+    config["fanout"] = fmt.Sprintf("%d", fanout)
     config["filename"] = filename
+    config["native"] = fmt.Sprintf("%t", native)
     config["expr"] = expr
+    config["write"] = write
+    config["writefilter"] = writefilter
     config["listdevice"] = fmt.Sprintf("%t", listdevice)
     config["profile"] = fmt.Sprintf("%t", profile)
     config["dumpproto"] = dumpproto
+    config["tstamp"] = tstamp
+    config["start"] = start
+    config["end"] = end
+    config["duration"] = duration
+    config["count"] = fmt.Sprintf("%d", count)
+    config["sample"] = fmt.Sprintf("%d", sample)
+    config["flowsample"] = fmt.Sprintf("%g", flowsample)
+    config["maxparsers"] = fmt.Sprintf("%d", maxparsers)
+    config["replay"] = replayto
+    config["speed"] = fmt.Sprintf("%g", speed)
+    config["pps"] = fmt.Sprintf("%g", pps)
+    config["mbps"] = fmt.Sprintf("%g", mbps)
+    config["loop"] = fmt.Sprintf("%d", loop)
+    config["rewrite"] = rewrite
+    config["generate"] = fmt.Sprintf("%d", generate)
+    config["genconc"] = fmt.Sprintf("%d", genconc)
+    config["gensize"] = fmt.Sprintf("%d", gensize)
+    config["genrate"] = fmt.Sprintf("%d", genrate)
+    config["genseed"] = fmt.Sprintf("%d", genseed)
     return config
 }
 
@@ -91,6 +254,25 @@ func active_profiling() {
     pprof.StartCPUProfile(fp)
 }
 
+func write_allocs_profile() {
+    fp, err := os.Create("profiling.mprof")
+    if err != nil {
+        fmt.Print(err)
+        return
+    }
+    pprof.Lookup("allocs").WriteTo(fp, 0)
+    fp.Close()
+}
+
+// show_allocs gives the allocations per packet since the last call
+func show_allocs(mem *runtime.MemStats, count int) string {
+    mallocs, bytes := mem.Mallocs, mem.TotalAlloc
+    runtime.ReadMemStats(mem)
+    return fmt.Sprintf("allocs/pkt=%.2f bytes/pkt=%.1f",
+        float64(mem.Mallocs-mallocs)/float64(count),
+        float64(mem.TotalAlloc-bytes)/float64(count))
+}
+
 func show_devices() {
     ifs, err := pcap.Findalldevs()
     if len(ifs) == 0 {
@@ -107,61 +289,250 @@ func show_devices() {
     }
 }
 
-func create_reader() *pcap.Pcap {
-    var pcapreader *pcap.Pcap
+func create_readers() []capture.PacketSource {
+    var source capture.PacketSource
     var err error
 
+    limits, err := capture.ParseLimits(CONFIG)
+    if err != nil {
+        fmt.Printf("usage: %s\n", err)
+        os.Exit(3)
+    }
+
+    if CONFIG["fanout"] != "1" {
+        if CONFIG["device"] == "" || strings.Contains(CONFIG["device"], ",") ||
+            CONFIG["backend"] != "afpacket" {
+            fmt.Printf("usage: -fanout needs a single -i <iface> -backend afpacket\n")
+            os.Exit(3)
+        }
+        if CONFIG["write"] != "" {
+            fmt.Printf("usage: -fanout cannot be used with -w\n")
+            os.Exit(3)
+        }
+        sources, err := capture.LiveFanout(CONFIG)
+        if err != nil {
+            fmt.Printf("Openlive(%s) failed: %s\n", CONFIG["device"], err)
+            os.Exit(1)
+        }
+        if limits != nil {
+            for i := range sources {
+                sources[i] = capture.NewSlice(sources[i], limits)
+            }
+        }
+        return sources
+    }
+
     if CONFIG["device"] != "" {
-        pcapreader, err = pcap.Openlive(CONFIG["device"], 65535, true, 0)
+        source, err = capture.Live(CONFIG)
         if err != nil {
             fmt.Printf("Openlive(%s) failed: %s\n", CONFIG["device"], err)
             os.Exit(1)
         }
     } else if CONFIG["filename"] != "" {
-        pcapreader, err = pcap.Openoffline(CONFIG["filename"])
+        source, err = capture.Offline(CONFIG)
         if err != nil {
             fmt.Printf("Openoffline(%s) failed: %s\n", CONFIG["filename"], err)
             os.Exit(2)
         }
+    } else if CONFIG["generate"] != "0" {
+        GENERATOR, err = capture.NewGenerator(CONFIG)
+        if err != nil {
+            fmt.Printf("usage: %s\n", err)
+            os.Exit(3)
+        }
+        source = GENERATOR
     } else {
-        fmt.Printf("usage: pcaptest [-i <iface> | -r <pcap file>]\n")
+        fmt.Printf("usage: pcaptest [-i <iface> | -r <pcap file> | -generate <flows>]\n")
         os.Exit(3)
     }
-    return pcapreader
+    if limits != nil {
+        source = capture.NewSlice(source, limits)
+    }
+
+    if CONFIG["write"] != "" {
+        source, err = capture.NewTee(source, CONFIG["write"], CONFIG["writefilter"],
+            capture.Precision(CONFIG))
+        if err != nil {
+            fmt.Printf("Write(%s) failed: %s\n", CONFIG["write"], err)
+            os.Exit(5)
+        }
+    }
+    return []capture.PacketSource{source}
+}
+
+// replay_file sends -r on the -replay interface, nothing is parsed
+func replay_file() {
+    opts, err := replay.ParseOptions(CONFIG)
+    if err != nil {
+        fmt.Printf("usage: %s\n", err)
+        os.Exit(3)
+    }
+    if CONFIG["filename"] == "" {
+        fmt.Printf("usage: -replay <iface> needs -r <pcap file>\n")
+        os.Exit(3)
+    }
+    if _, err = capture.ParseLimits(CONFIG); err != nil {
+        fmt.Printf("usage: %s\n", err)
+        os.Exit(3)
+    }
+    var injector replay.Injector
+    if CONFIG["backend"] == "afpacket" {
+        injector, err = afpacket.OpenInject(CONFIG["replay"])
+    } else {
+        var handle *pcap.Pcap
+        if handle, err = pcap.Openlive(CONFIG["replay"], 65535, false, 1000); err == nil {
+            injector = handle
+        }
+    }
+    if err != nil {
+        fmt.Printf("Openlive(%s) failed: %s\n", CONFIG["replay"], err)
+        os.Exit(1)
+    }
+
+    player := replay.New(injector, opts)
+    go func() {
+        ch := make(chan os.Signal, 1)
+        signal.Notify(ch, syscall.SIGINT)
+        <-ch
+        fmt.Println("CTRL-C; stopping")
+        player.Stop()
+    }()
+    timebegin := time.Now()
+    err = player.Run(func() (capture.PacketSource, error) {
+        source, err := capture.Offline(CONFIG)
+        if err != nil {
+            return nil, err
+        }
+        // the limits count from the first packet of each pass
+        if limits, _ := capture.ParseLimits(CONFIG); limits != nil {
+            source = capture.NewSlice(source, limits)
+        }
+        return source, nil
+    })
+    injector.Close()
+    fmt.Printf("replay to %s: %s in %s\n", CONFIG["replay"], player.Show(), time.Since(timebegin))
+    if err != nil {
+        fmt.Printf("replay failed: %s\n", err)
+        os.Exit(1)
+    }
+}
+
+func close_source(r *reader) {
+    r.closing.Do(func() {
+        fmt.Printf("reader %d: %d pkts, capture stats: %s\n",
+            r.id, atomic.LoadUint64(&r.count), show_stats(r.source))
+        r.source.Close()
+    })
 }
 
-func readPackets(pcapreader *pcap.Pcap, quit_chan chan bool) {
+func show_stats(source capture.PacketSource) string {
+    stats, err := source.Stats()
+    if err != nil {
+        return fmt.Sprint("unavailable: ", err)
+    }
+    return fmt.Sprintf("received=%d dropped=%d ifdropped=%d",
+        stats.Received, stats.Dropped, stats.IfDropped)
+}
+
+func show_readers() {
+    for _, r := range READERS {
+        fmt.Printf("reader %d: %d pkts, %s\n",
+            r.id, atomic.LoadUint64(&r.count), show_stats(r.source))
+    }
+}
+
+// readAll runs the readers, all feeding the same maps, until the last
+// one has nothing more to read
+func readAll(quit_chan chan bool) {
+    var wg sync.WaitGroup
+    for _, r := range READERS {
+        wg.Add(1)
+        go func(r *reader) {
+            readPackets(r)
+            wg.Done()
+        }(r)
+    }
+    wg.Wait()
+    fmt.Print("Nothing more to read\n")
+    if data.SAMPLER != nil && CONFIG["debug"] == "true" {
+        fmt.Printf("sampling: %d pkts parsed, %d dropped, scale %g\n",
+            atomic.LoadUint64(&data.SAMPLER.Kept), atomic.LoadUint64(&data.SAMPLER.Dropped),
+            data.SAMPLER.Scale())
+    }
+    if GENERATOR != nil {
+        fmt.Printf("generated: %s\n", GENERATOR.Totals())
+    }
+    PARSERS.Wait()
+    quit_chan <- true
+}
+
+func readPackets(r *reader) {
+    source := r.source
     count := 0
     timebegin := time.Now()
-    for pkt := pcapreader.Next(); pkt != nil; pkt = pcapreader.Next() {
-        go launchParser(pkt)
+    var mem runtime.MemStats
+    runtime.ReadMemStats(&mem)
+    for pkt := source.Next(); pkt != nil; pkt = source.Next() {
         count += 1
+        atomic.StoreUint64(&r.count, uint64(count))
+        if data.SAMPLER.Keep(pkt) && data.SHEDDER.Acquire() {
+            PARSERS.Add(1)
+            go launchParser(pkt)
+        } else {
+            pkt.Release()
+        }
         if count%1000000 == 0 {
-            fmt.Println("num pkts=", count, "in", time.Now().Sub(timebegin))
+            fmt.Printf("reader %d: ", r.id)
+            fmt.Println("num pkts=", count, "in", time.Now().Sub(timebegin),
+                show_stats(source))
+            if CONFIG["profile"] == "true" {
+                fmt.Println(show_allocs(&mem, 1000000))
+            }
             timebegin = time.Now()
         }
     }
-    fmt.Print("Nothing more to read\n")
-    quit_chan <- true
+    if err := source.Err(); err != nil {
+        fmt.Printf("reader %d: read error: %s\n", r.id, err)
+    }
+    close_source(r)
+    if tee, ok := source.(*capture.Tee); ok && CONFIG["debug"] == "true" {
+        fmt.Printf("pkts written to %s: %d (%d skipped)\n",
+            CONFIG["write"], tee.Written, tee.Skipped)
+    }
 }
 
 func launchParser(pkt *pcap.Packet) {
-    ethpkt := data.ParseEthernet(data.ETHMAP, pkt, CONFIG)
-    clock.Clock.Set(ethpkt.Time)
-    if ethpkt.Type == 0x800 {
+    defer PARSERS.Done()
+    defer data.SHEDDER.Release()
+    defer pkt.Release()
+    clock.Clock.Set(pkt.Time)
+    ethpkt := data.ParseLink(data.ETHMAP, pkt, CONFIG)
+    if ethpkt == nil {
+        return
+    }
+    data.ParseVlan(data.VlanMAP, ethpkt, CONFIG)
+    switch ethpkt.Type {
+    case data.ETHERTYPE_IPV4:
         data.ParseIpv4(data.IPv4MAP, ethpkt, CONFIG)
+    case data.ETHERTYPE_IPV6:
+        data.ParseIpv6(data.IPv6MAP, ethpkt, CONFIG)
+    case data.ETHERTYPE_ARP:
+        data.ParseArp(data.ARPTABLE, ethpkt, CONFIG)
     }
 }
 
-func signalCatcher(pcapreader *pcap.Pcap) {
-    ch := make(chan os.Signal)
+func signalCatcher() {
+    ch := make(chan os.Signal, 1)
     signal.Notify(ch, syscall.SIGINT)
     <-ch
     fmt.Println("CTRL-C; exiting")
-    pcapreader.Close()
+    // the readers close their source when Next returns
+    for _, r := range READERS {
+        r.source.Breakloop()
+    }
 }
 
-func controler(pcapreader *pcap.Pcap, quit_chan chan bool) {
+func controler(quit_chan chan bool) {
     timebegin := time.Now()
 
 MAIN:
@@ -170,33 +541,36 @@ MAIN:
 
         case <-quit_chan:
 
+            // the final dumps flush the stats and stop the handlers
             fmt.Print("\nEND\n")
-            fmt.Printf("ETH routines: %d\n", len(data.ETHMAP.StatsChans))
-            for _, chans := range data.ETHMAP.StatsChans {
-                chans.Control <- "<kill>"
-            }
-            fmt.Printf("IP  routines: %d\n", len(data.IPv4MAP.StatsChans))
-            for _, chans := range data.IPv4MAP.StatsChans {
-                chans.Control <- "<kill>"
-            }
-            fmt.Printf("TCP routines: %d\n", len(data.TcpMAP.StatsChans))
-            for _, chans := range data.TcpMAP.StatsChans {
-                chans.Control <- "<kill>"
-            }
+            dump.WriteEthernet(CONFIG, data.ETHMAP, true)
+            dump.WriteIpv4(CONFIG, data.IPv4MAP, true)
+            dump.WriteIpv6(CONFIG, data.IPv6MAP, true)
+            dump.WriteTcp(CONFIG, data.TcpMAP, true)
+            dump.WriteUdp(CONFIG, data.UdpMAP, true)
+            dump.WriteIcmp(CONFIG, data.IcmpMAP, true)
+            dump.WriteArp(CONFIG, data.ARPTABLE, true)
+            dump.WriteVlan(CONFIG, data.VlanMAP, true)
+            dump.WriteShed(CONFIG)
             break MAIN
 
         case <-clock.Clock.DumpChan:
 
             dumpbegin := time.Now()
-            pcapreader.Paused = true
-            dump.WriteEthernet(CONFIG, data.ETHMAP)
-            dump.WriteIpv4(CONFIG, data.IPv4MAP)
-            dump.WriteTcp(CONFIG, data.TcpMAP)
-            pcapreader.Paused = false
+            dump.WriteEthernet(CONFIG, data.ETHMAP, false)
+            dump.WriteIpv4(CONFIG, data.IPv4MAP, false)
+            dump.WriteIpv6(CONFIG, data.IPv6MAP, false)
+            dump.WriteTcp(CONFIG, data.TcpMAP, false)
+            dump.WriteUdp(CONFIG, data.UdpMAP, false)
+            dump.WriteIcmp(CONFIG, data.IcmpMAP, false)
+            dump.WriteArp(CONFIG, data.ARPTABLE, false)
+            dump.WriteVlan(CONFIG, data.VlanMAP, false)
+            dump.WriteShed(CONFIG)
 
             if CONFIG["debug"] == "true" {
+                show_readers()
                 fmt.Println("<< END DUMPS ", time.Now().Sub(dumpbegin),
-                    clock.Clock.Get(), "\n")
+                    clock.Clock.Get())
             }
         }
     }
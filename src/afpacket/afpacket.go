@@ -0,0 +1,449 @@
+//go:build linux
+// +build linux
+
+package afpacket
+
+/* capture with an AF_PACKET socket and a TPACKET_V3 mmap ring,
+   no libpcap needed */
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+    "unsafe"
+
+    "pcap"
+)
+
+// from linux/if_packet.h, missing in syscall
+const (
+    PACKET_VERSION = 10
+    PACKET_FANOUT  = 18
+    TPACKET_V3     = 2
+
+    PACKET_FANOUT_HASH        = 0
+    PACKET_FANOUT_FLAG_DEFRAG = 0x8000
+
+    TP_STATUS_KERNEL          = 0
+    TP_STATUS_USER            = 1 << 0
+    TP_STATUS_VLAN_VALID      = 1 << 4
+    TP_STATUS_VLAN_TPID_VALID = 1 << 6
+
+    // tpacket_block_desc, tpacket_hdr_v1 inside
+    BLOCK_STATUS       = 8
+    BLOCK_NUM_PKTS     = 12
+    BLOCK_FIRST_OFFSET = 16
+
+    // tpacket3_hdr
+    PKT_NEXT_OFFSET = 0
+    PKT_SEC         = 4
+    PKT_NSEC        = 8
+    PKT_SNAPLEN     = 12
+    PKT_LEN         = 16
+    PKT_STATUS      = 20
+    PKT_MAC         = 24
+    PKT_VLAN_TCI    = 32
+    PKT_VLAN_TPID   = 36
+
+    FRAME_SIZE = 2048
+
+    // poll.h
+    POLLERR  = 0x8
+    POLLNVAL = 0x20
+)
+
+type Options struct {
+    BlockSize  int           // bytes, a multiple of the page size
+    BlockCount int           // blocks in the ring
+    Timeout    time.Duration // a block goes to user space after this delay
+    Snaplen    int
+    Promisc    bool
+    Fanout     int // fanout group id, 0 for none; a flow stays on one socket
+    // compiled filter, attached before the bind so that the ring only
+    // gets the matching packets; nil for none
+    Filter []pcap.BPFInstruction
+}
+
+var DefaultOptions = Options{
+    BlockSize:  1 << 20,
+    BlockCount: 64,
+    Timeout:    100 * time.Millisecond,
+    Snaplen:    65535,
+    Promisc:    true,
+}
+
+// struct tpacket_req3
+type tpacketReq3 struct {
+    blockSize      uint32
+    blockNr        uint32
+    frameSize      uint32
+    frameNr        uint32
+    retireBlkTov   uint32
+    sizeofPriv     uint32
+    featureReqWord uint32
+}
+
+// struct tpacket_stats_v3
+type tpacketStatsV3 struct {
+    packets      uint32
+    drops        uint32
+    freezeQCount uint32
+}
+
+// struct packet_mreq
+type packetMreq struct {
+    ifindex int32
+    mrtype  uint16
+    alen    uint16
+    address [8]byte
+}
+
+// Handle reads a TPACKET_V3 ring; it is a capture.PacketSource
+type Handle struct {
+    fd      int
+    ring    []byte
+    opts    Options
+    mtx     sync.Mutex // held by Next, Close waits for it
+    closing int32
+    err     error // read error which ended Next
+
+    block    int    // current block
+    pkt      uint32 // packets left in the current block
+    offset   int    // offset of the next packet in the ring
+    received uint64
+    dropped  uint64
+}
+
+// Openlive binds a ring to device
+func Openlive(device string, opts Options) (*Handle, error) {
+    iface, err := net.InterfaceByName(device)
+    if err != nil {
+        return nil, err
+    }
+    if iface.Flags&net.FlagUp == 0 {
+        // the bind would work, and nothing would come
+        return nil, fmt.Errorf("%s is down", device)
+    }
+    if opts.BlockSize <= 0 || opts.BlockSize%syscall.Getpagesize() != 0 {
+        return nil, fmt.Errorf("block size %d is not a multiple of the page size", opts.BlockSize)
+    }
+    if opts.BlockCount <= 0 {
+        return nil, fmt.Errorf("bad block count %d", opts.BlockCount)
+    }
+    if opts.Timeout < time.Millisecond {
+        return nil, fmt.Errorf("block timeout %s is too short", opts.Timeout)
+    }
+
+    // no protocol until the bind: nothing comes before the filter
+    fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+    if err != nil {
+        return nil, fmt.Errorf("socket: %s", err)
+    }
+    handle := &Handle{fd: fd, opts: opts}
+    if err = handle.setup(iface.Index); err != nil {
+        handle.release()
+        return nil, err
+    }
+    return handle, nil
+}
+
+func (handle *Handle) setup(ifindex int) error {
+    if err := syscall.SetsockoptInt(handle.fd, syscall.SOL_PACKET, PACKET_VERSION, TPACKET_V3); err != nil {
+        return fmt.Errorf("TPACKET_V3 not supported: %s", err)
+    }
+    req := tpacketReq3{
+        blockSize:    uint32(handle.opts.BlockSize),
+        blockNr:      uint32(handle.opts.BlockCount),
+        frameSize:    FRAME_SIZE,
+        frameNr:      uint32(handle.opts.BlockSize / FRAME_SIZE * handle.opts.BlockCount),
+        retireBlkTov: uint32(handle.opts.Timeout / time.Millisecond),
+    }
+    if err := setsockopt(handle.fd, syscall.SOL_PACKET, syscall.PACKET_RX_RING,
+        unsafe.Pointer(&req), unsafe.Sizeof(req)); err != nil {
+        return fmt.Errorf("PACKET_RX_RING: %s", err)
+    }
+    ring, err := syscall.Mmap(handle.fd, 0, handle.opts.BlockSize*handle.opts.BlockCount,
+        syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+    if err != nil {
+        return fmt.Errorf("mmap: %s", err)
+    }
+    handle.ring = ring
+
+    if handle.opts.Promisc {
+        mreq := packetMreq{ifindex: int32(ifindex), mrtype: syscall.PACKET_MR_PROMISC}
+        if err := setsockopt(handle.fd, syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP,
+            unsafe.Pointer(&mreq), unsafe.Sizeof(mreq)); err != nil {
+            return fmt.Errorf("promiscuous mode: %s", err)
+        }
+    }
+
+    if handle.opts.Filter != nil {
+        if err := handle.SetBPF(handle.opts.Filter); err != nil {
+            return fmt.Errorf("filter: %s", err)
+        }
+    }
+
+    addr := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: ifindex}
+    if err := syscall.Bind(handle.fd, addr); err != nil {
+        return fmt.Errorf("bind: %s", err)
+    }
+
+    if handle.opts.Fanout != 0 {
+        // hash on the flow, fragments reassembled so that they hash alike
+        mode := (PACKET_FANOUT_HASH | PACKET_FANOUT_FLAG_DEFRAG) << 16
+        if err := syscall.SetsockoptInt(handle.fd, syscall.SOL_PACKET, PACKET_FANOUT,
+            handle.opts.Fanout&0xFFFF|mode); err != nil {
+            return fmt.Errorf("PACKET_FANOUT group %d: %s", handle.opts.Fanout, err)
+        }
+    }
+    return nil
+}
+
+// SetBPF attaches a compiled filter to the socket, the kernel drops
+// the other packets before they reach the ring; once bound, the ring
+// may already hold some, Options.Filter is attached before the bind
+func (handle *Handle) SetBPF(insns []pcap.BPFInstruction) error {
+    if len(insns) == 0 {
+        return errors.New("empty filter")
+    }
+    filter := make([]syscall.SockFilter, len(insns))
+    for i, insn := range insns {
+        filter[i] = syscall.SockFilter{Code: insn.Code, Jt: insn.Jt, Jf: insn.Jf, K: insn.K}
+    }
+    return syscall.AttachLsf(handle.fd, filter)
+}
+
+// Next returns the next packet, nil after Breakloop or Close, or on a
+// socket error, see Err
+func (handle *Handle) Next() *pcap.Packet {
+    handle.mtx.Lock()
+    defer handle.mtx.Unlock()
+
+    for handle.pkt == 0 {
+        if atomic.LoadInt32(&handle.closing) != 0 {
+            return nil
+        }
+        if !handle.nextBlock() {
+            if err := handle.poll(); err != nil {
+                handle.err = err
+                return nil
+            }
+        }
+    }
+
+    ring := handle.ring
+    offset := handle.offset
+    status := handle.u32(offset + PKT_STATUS)
+    snaplen := int(handle.u32(offset + PKT_SNAPLEN))
+    start := offset + int(handle.u16(offset+PKT_MAC))
+    data := ring[start : start+snaplen]
+
+    // the kernel strips the VLAN tag, put it back for the parsers
+    var tag [4]byte
+    tagged := status&TP_STATUS_VLAN_VALID != 0 && snaplen >= 12
+    caplen := snaplen
+    if tagged {
+        tpid := uint16(0x8100)
+        if status&TP_STATUS_VLAN_TPID_VALID != 0 {
+            tpid = handle.u16(offset + PKT_VLAN_TPID)
+        }
+        tci := uint16(handle.u32(offset + PKT_VLAN_TCI))
+        tag = [4]byte{byte(tpid >> 8), byte(tpid), byte(tci >> 8), byte(tci)}
+        caplen += 4
+    }
+    if caplen > handle.opts.Snaplen {
+        caplen = handle.opts.Snaplen
+    }
+
+    pkt := pcap.NewPacket(uint32(caplen))
+    if tagged {
+        n := copy(pkt.Data, data[:12])
+        n += copy(pkt.Data[n:], tag[:])
+        copy(pkt.Data[n:], data[12:])
+    } else {
+        copy(pkt.Data, data)
+    }
+    pkt.Time = time.Unix(int64(handle.u32(offset+PKT_SEC)), int64(handle.u32(offset+PKT_NSEC)))
+    pkt.Len = handle.u32(offset + PKT_LEN)
+    if tagged {
+        pkt.Len += 4
+    }
+    pkt.LinkType = pcap.LINKTYPE_ETHERNET
+
+    handle.pkt--
+    handle.offset += int(handle.u32(offset + PKT_NEXT_OFFSET))
+    if handle.pkt == 0 {
+        handle.releaseBlock()
+    }
+    return pkt
+}
+
+// nextBlock starts on the current block if the kernel gave it to us
+func (handle *Handle) nextBlock() bool {
+    base := handle.block * handle.opts.BlockSize
+    if atomic.LoadUint32(handle.u32ptr(base+BLOCK_STATUS))&TP_STATUS_USER == 0 {
+        return false
+    }
+    handle.pkt = handle.u32(base + BLOCK_NUM_PKTS)
+    handle.offset = base + int(handle.u32(base+BLOCK_FIRST_OFFSET))
+    if handle.pkt == 0 {
+        handle.releaseBlock()
+    }
+    return true
+}
+
+// releaseBlock gives the current block back to the kernel
+func (handle *Handle) releaseBlock() {
+    base := handle.block * handle.opts.BlockSize
+    atomic.StoreUint32(handle.u32ptr(base+BLOCK_STATUS), TP_STATUS_KERNEL)
+    handle.block = (handle.block + 1) % handle.opts.BlockCount
+}
+
+// poll waits for a block, at most one block timeout so that Close
+// is noticed. A socket error, ENETDOWN when the interface goes down,
+// is returned.
+func (handle *Handle) poll() error {
+    pollfd := struct {
+        fd      int32
+        events  int16
+        revents int16
+    }{int32(handle.fd), 0x1 /* POLLIN */, 0}
+    timeout := syscall.NsecToTimespec(int64(handle.opts.Timeout))
+    _, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pollfd)), 1,
+        uintptr(unsafe.Pointer(&timeout)), 0, 0, 0)
+    if errno != 0 && errno != syscall.EINTR {
+        return errno
+    }
+    if pollfd.revents&(POLLERR|POLLNVAL) != 0 {
+        soerr, err := syscall.GetsockoptInt(handle.fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+        if err != nil {
+            return err
+        }
+        if soerr != 0 {
+            return syscall.Errno(soerr)
+        }
+    }
+    return nil
+}
+
+// Stats reads the socket counters; the kernel resets them on each read
+func (handle *Handle) Stats() (*pcap.Stats, error) {
+    var stats tpacketStatsV3
+    size := uint32(unsafe.Sizeof(stats))
+    _, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(handle.fd),
+        syscall.SOL_PACKET, syscall.PACKET_STATISTICS,
+        uintptr(unsafe.Pointer(&stats)), uintptr(unsafe.Pointer(&size)), 0)
+    if errno != 0 {
+        return nil, errno
+    }
+    received := atomic.AddUint64(&handle.received, uint64(stats.packets))
+    dropped := atomic.AddUint64(&handle.dropped, uint64(stats.drops))
+    return &pcap.Stats{Received: received, Dropped: dropped}, nil
+}
+
+func (handle *Handle) LinkType() int {
+    return pcap.LINKTYPE_ETHERNET
+}
+
+// Breakloop makes Next return nil, from another goroutine
+func (handle *Handle) Breakloop() {
+    atomic.StoreInt32(&handle.closing, 1)
+}
+
+// Err is the socket error which ended Next
+func (handle *Handle) Err() error {
+    return handle.err
+}
+
+func (handle *Handle) Close() {
+    atomic.StoreInt32(&handle.closing, 1)
+    handle.mtx.Lock()
+    defer handle.mtx.Unlock()
+    handle.release()
+}
+
+func (handle *Handle) release() {
+    if handle.ring != nil {
+        syscall.Munmap(handle.ring)
+        handle.ring = nil
+    }
+    if handle.fd >= 0 {
+        syscall.Close(handle.fd)
+        handle.fd = -1
+    }
+}
+
+// the ring structures are in host byte order
+func (handle *Handle) u32ptr(offset int) *uint32 {
+    return (*uint32)(unsafe.Pointer(&handle.ring[offset]))
+}
+
+func (handle *Handle) u32(offset int) uint32 {
+    return *handle.u32ptr(offset)
+}
+
+func (handle *Handle) u16(offset int) uint16 {
+    return *(*uint16)(unsafe.Pointer(&handle.ring[offset]))
+}
+
+func setsockopt(fd, level, name int, value unsafe.Pointer, size uintptr) error {
+    _, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), uintptr(level),
+        uintptr(name), uintptr(value), size, 0)
+    if errno != 0 {
+        return errno
+    }
+    return nil
+}
+
+func htons(value uint16) uint16 {
+    probe := uint16(1)
+    if *(*byte)(unsafe.Pointer(&probe)) == 0 {
+        // big endian host
+        return value
+    }
+    return value<<8 | value>>8
+}
+
+// Injector sends frames on a device, through an AF_PACKET socket which
+// receives nothing
+type Injector struct {
+    fd int
+}
+
+func OpenInject(device string) (*Injector, error) {
+    iface, err := net.InterfaceByName(device)
+    if err != nil {
+        return nil, err
+    }
+    if iface.Flags&net.FlagUp == 0 {
+        return nil, fmt.Errorf("%s is down", device)
+    }
+    // protocol 0: no packet is queued for reading
+    fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+    if err != nil {
+        return nil, fmt.Errorf("socket: %s", err)
+    }
+    if err = syscall.Bind(fd, &syscall.SockaddrLinklayer{Ifindex: iface.Index}); err != nil {
+        syscall.Close(fd)
+        return nil, fmt.Errorf("bind: %s", err)
+    }
+    return &Injector{fd: fd}, nil
+}
+
+// Inject sends one frame, link header included
+func (injector *Injector) Inject(data []byte) error {
+    for {
+        _, err := syscall.Write(injector.fd, data)
+        if err != syscall.EINTR {
+            return err
+        }
+    }
+}
+
+func (injector *Injector) Close() {
+    syscall.Close(injector.fd)
+}
@@ -0,0 +1,68 @@
+//go:build !linux
+// +build !linux
+
+package afpacket
+
+import (
+    "errors"
+    "time"
+
+    "pcap"
+)
+
+type Options struct {
+    BlockSize  int
+    BlockCount int
+    Timeout    time.Duration
+    Snaplen    int
+    Promisc    bool
+    Fanout     int
+    Filter     []pcap.BPFInstruction
+}
+
+var DefaultOptions = Options{}
+
+type Handle struct{}
+
+func Openlive(device string, opts Options) (*Handle, error) {
+    return nil, errors.New("AF_PACKET is only available on Linux")
+}
+
+func (handle *Handle) SetBPF(insns []pcap.BPFInstruction) error {
+    return errors.New("AF_PACKET is only available on Linux")
+}
+
+func (handle *Handle) Next() *pcap.Packet {
+    return nil
+}
+
+func (handle *Handle) Stats() (*pcap.Stats, error) {
+    return nil, errors.New("AF_PACKET is only available on Linux")
+}
+
+func (handle *Handle) LinkType() int {
+    return pcap.LINKTYPE_ETHERNET
+}
+
+func (handle *Handle) Breakloop() {
+}
+
+func (handle *Handle) Err() error {
+    return nil
+}
+
+func (handle *Handle) Close() {
+}
+
+type Injector struct{}
+
+func OpenInject(device string) (*Injector, error) {
+    return nil, errors.New("AF_PACKET is only available on Linux")
+}
+
+func (injector *Injector) Inject(data []byte) error {
+    return errors.New("AF_PACKET is only available on Linux")
+}
+
+func (injector *Injector) Close() {
+}
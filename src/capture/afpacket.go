@@ -0,0 +1,94 @@
+package capture
+
+import (
+    "fmt"
+    "os"
+    "strconv"
+    "time"
+
+    "afpacket"
+    "pcap"
+)
+
+// liveAfpacket opens config["device"] with an AF_PACKET ring, sized by
+// config["blocksize"] and config["blocks"], filtered in the kernel by
+// config["expr"]
+func liveAfpacket(config map[string]string) (PacketSource, error) {
+    opts, err := afpacketOptions(config)
+    if err != nil {
+        return nil, err
+    }
+    return openAfpacket(config, opts)
+}
+
+// LiveFanout opens config["fanout"] AF_PACKET rings on config["device"],
+// joined in one PACKET_FANOUT group: the kernel hashes each flow to a
+// single ring, one reader can run on each
+func LiveFanout(config map[string]string) ([]PacketSource, error) {
+    count, err := strconv.Atoi(config["fanout"])
+    if err != nil || count < 1 {
+        return nil, fmt.Errorf("bad fanout %q", config["fanout"])
+    }
+    opts, err := afpacketOptions(config)
+    if err != nil {
+        return nil, err
+    }
+    // the group id is global to the host, one per process
+    opts.Fanout = os.Getpid()&0xFFFF | 1
+    sources := make([]PacketSource, 0, count)
+    for i := 0; i < count; i++ {
+        source, err := NewReopen(config["device"], func() (PacketSource, error) {
+            return openAfpacket(config, opts)
+        })
+        if err != nil {
+            for _, source := range sources {
+                source.Close()
+            }
+            return nil, err
+        }
+        sources = append(sources, &Named{source, config["device"]})
+    }
+    return sources, nil
+}
+
+// afpacketOptions sizes the ring; snaplen, promiscuous mode and timeout
+// come from the handle options, the timeout retires the blocks
+func afpacketOptions(config map[string]string) (afpacket.Options, error) {
+    live, err := LiveOptions(config)
+    if err != nil {
+        return afpacket.Options{}, err
+    }
+    if live.Direction != pcap.DIRECTION_INOUT {
+        return afpacket.Options{}, fmt.Errorf("direction %q not supported by afpacket", config["direction"])
+    }
+    opts := afpacket.DefaultOptions
+    opts.Snaplen = int(live.Snaplen)
+    opts.Promisc = live.Promisc
+    if config["timeout"] != "" && config["timeout"] != "0" {
+        opts.Timeout = time.Duration(live.Timeout) * time.Millisecond
+    }
+    if size, err := strconv.Atoi(config["blocksize"]); err == nil {
+        opts.BlockSize = size
+    }
+    if count, err := strconv.Atoi(config["blocks"]); err == nil {
+        opts.BlockCount = count
+    }
+    return opts, nil
+}
+
+func openAfpacket(config map[string]string, opts afpacket.Options) (PacketSource, error) {
+    if expr := config["expr"]; expr != "" {
+        // the filter goes with the socket, before any packet
+        bpf, err := pcap.Compile(pcap.LINKTYPE_ETHERNET, int32(opts.Snaplen), expr)
+        if err != nil {
+            return nil, filterError(expr, err)
+        }
+        defer bpf.Free()
+        opts.Filter = bpf.Instructions()
+    }
+    handle, err := afpacket.Openlive(config["device"], opts)
+    if err != nil {
+        return nil, err
+    }
+    return handle, nil
+}
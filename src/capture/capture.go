@@ -0,0 +1,191 @@
+package capture
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+
+    "pcap"
+)
+
+// PacketSource is what the pipeline reads packets from: a live
+// libpcap handle, a savefile, a generator...
+type PacketSource interface {
+    // Next returns the next packet, or nil when there is nothing more to read
+    Next() *pcap.Packet
+    Close()
+    Stats() (*pcap.Stats, error)
+    LinkType() int
+    // Breakloop makes Next return nil soon, from another goroutine; the
+    // reader then closes the source
+    Breakloop()
+    // Err tells why Next returned nil: the read error, or nil at the end
+    Err() error
+}
+
+// Live opens config["device"] with libpcap, or the backend given by
+// config["backend"], filtered by config["expr"]. Several devices,
+// separated by commas, are merged in timestamp order. The packets are
+// tagged with their device. A device that fails is reopened.
+func Live(config map[string]string) (PacketSource, error) {
+    devices := strings.Split(config["device"], ",")
+    if len(devices) == 1 {
+        source, err := NewReopen(config["device"], func() (PacketSource, error) {
+            return liveDevice(config)
+        })
+        if err != nil {
+            return nil, err
+        }
+        return &Named{source, config["device"]}, nil
+    }
+
+    sources := make([]PacketSource, 0, len(devices))
+    for _, device := range devices {
+        source, err := Live(with(config, "device", device))
+        if err != nil {
+            for _, source := range sources {
+                source.Close()
+            }
+            return nil, fmt.Errorf("%s: %s", device, err)
+        }
+        sources = append(sources, source)
+    }
+    return NewMerge(sources), nil
+}
+
+func liveDevice(config map[string]string) (PacketSource, error) {
+    if config["backend"] == "afpacket" {
+        return liveAfpacket(config)
+    }
+    opts, err := LiveOptions(config)
+    if err != nil {
+        return nil, err
+    }
+    handle, warning, err := pcap.OpenliveOptions(config["device"], opts)
+    if err != nil {
+        return nil, err
+    }
+    if warning != nil {
+        fmt.Printf("warning: %s: %s\n", config["device"], warning)
+    }
+    if err = setfilter(handle, config["expr"]); err != nil {
+        handle.Close()
+        return nil, err
+    }
+    return handle, nil
+}
+
+// Offline opens config["filename"], with libpcap unless the native
+// reader is asked for, filtered by config["expr"]. Compressed files and
+// stdin ("-") always go to the native reader. A directory or a glob is
+// read as one stream, see Files.
+func Offline(config map[string]string) (PacketSource, error) {
+    files, err := ExpandFiles(config["filename"])
+    if err != nil {
+        return nil, err
+    }
+    if len(files) > 1 {
+        return NewFiles(config, files)
+    }
+    return offlineFile(with(config, "filename", files[0]))
+}
+
+func offlineFile(config map[string]string) (PacketSource, error) {
+    compressed, err := pcap.IsCompressed(config["filename"])
+    if err != nil {
+        return nil, err
+    }
+    if config["native"] == "true" || compressed {
+        reader, err := pcap.Openfile(config["filename"])
+        if err != nil {
+            return nil, err
+        }
+        if config["expr"] == "" {
+            return reader, nil
+        }
+        filter, err := NewFilter(reader, config["expr"])
+        if err != nil {
+            reader.Close()
+            return nil, err
+        }
+        return filter, nil
+    }
+    handle, err := pcap.OpenofflineWithPrecision(config["filename"], Precision(config))
+    if err != nil {
+        return nil, err
+    }
+    if err = setfilter(handle, config["expr"]); err != nil {
+        handle.Close()
+        return nil, err
+    }
+    return handle, nil
+}
+
+func setfilter(handle *pcap.Pcap, expr string) error {
+    if expr == "" {
+        return nil
+    }
+    if err := handle.Setfilter(expr); err != nil {
+        return filterError(expr, err)
+    }
+    return nil
+}
+
+// LiveOptions reads the handle configuration: config["snaplen"],
+// config["promisc"], config["timeout"] in ms, config["buffer"] in
+// bytes, config["immediate"], config["direction"] (in, out or inout)
+// and config["tstamp"]. Missing values, and a 0 timeout, keep the
+// defaults.
+func LiveOptions(config map[string]string) (pcap.LiveOptions, error) {
+    opts := pcap.DefaultLiveOptions
+    opts.Precision = Precision(config)
+    for key, value := range map[string]*int32{
+        "snaplen": &opts.Snaplen,
+        "timeout": &opts.Timeout,
+        "buffer":  &opts.BufferSize,
+    } {
+        if config[key] == "" || (key == "timeout" && config[key] == "0") {
+            continue
+        }
+        parsed, err := strconv.ParseInt(config[key], 10, 32)
+        if err != nil || parsed < 0 {
+            return opts, fmt.Errorf("bad %s %q", key, config[key])
+        }
+        *value = int32(parsed)
+    }
+    if config["promisc"] != "" {
+        opts.Promisc = config["promisc"] == "true"
+    }
+    if config["immediate"] != "" {
+        opts.Immediate = config["immediate"] == "true"
+    }
+    switch config["direction"] {
+    case "", "inout":
+        opts.Direction = pcap.DIRECTION_INOUT
+    case "in":
+        opts.Direction = pcap.DIRECTION_IN
+    case "out":
+        opts.Direction = pcap.DIRECTION_OUT
+    default:
+        return opts, fmt.Errorf("bad direction %q: in, out or inout", config["direction"])
+    }
+    return opts, nil
+}
+
+// with copies config, with key set to value
+func with(config map[string]string, key, value string) map[string]string {
+    copied := make(map[string]string, len(config))
+    for k, v := range config {
+        copied[k] = v
+    }
+    copied[key] = value
+    return copied
+}
+
+// Precision reads config["tstamp"], "micro" or "nano"
+func Precision(config map[string]string) int {
+    if config["tstamp"] == "nano" {
+        return pcap.TSTAMP_PRECISION_NANO
+    }
+    return pcap.TSTAMP_PRECISION_MICRO
+}
@@ -0,0 +1,209 @@
+package capture
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "pcap"
+)
+
+// ExpandFiles lists the files behind -r: the files of a directory, the
+// matches of a glob, or the name itself. Sorted by name.
+func ExpandFiles(name string) ([]string, error) {
+    if name == "-" {
+        return []string{name}, nil
+    }
+    if info, err := os.Stat(name); err == nil && info.IsDir() {
+        entries, err := os.ReadDir(name)
+        if err != nil {
+            return nil, err
+        }
+        files := make([]string, 0, len(entries))
+        for _, entry := range entries {
+            if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+                files = append(files, filepath.Join(name, entry.Name()))
+            }
+        }
+        if len(files) == 0 {
+            return nil, fmt.Errorf("no file in %s", name)
+        }
+        return files, nil
+    }
+    if strings.ContainsAny(name, "*?[") {
+        files, err := filepath.Glob(name)
+        if err != nil {
+            return nil, err
+        }
+        if len(files) == 0 {
+            return nil, fmt.Errorf("no file matches %s", name)
+        }
+        sort.Strings(files)
+        return files, nil
+    }
+    return []string{name}, nil
+}
+
+type fileStart struct {
+    name  string
+    first time.Time
+}
+
+type fileHead struct {
+    name   string
+    source PacketSource
+    next   *pcap.Packet
+}
+
+// Files reads several savefiles as one stream in timestamp order, like
+// mergecap. A file is only opened when the stream reaches its first
+// packet, so rotated captures keep a few files open at a time.
+type Files struct {
+    config   map[string]string
+    pending  []fileStart // not opened yet, by first packet time
+    open     []*fileHead
+    closed   pcap.Stats // counters of the files already read
+    linktype int
+    broken   int32 // atomic, set by Breakloop
+    err      error // first read error, the next files are still read
+}
+
+// NewFiles reads the first packet of each file to order them
+func NewFiles(config map[string]string, names []string) (*Files, error) {
+    files := &Files{config: config, linktype: -1}
+    for _, name := range names {
+        source, err := offlineFile(with(config, "filename", name))
+        if err != nil {
+            return nil, fmt.Errorf("%s: %s", name, err)
+        }
+        pkt := source.Next()
+        if files.linktype < 0 {
+            files.linktype = source.LinkType()
+        }
+        source.Close()
+        if pkt == nil {
+            // no packet, or none matching the filter
+            continue
+        }
+        files.pending = append(files.pending, fileStart{name, pkt.Time})
+        pkt.Release()
+    }
+    sort.SliceStable(files.pending, func(i, j int) bool {
+        return files.pending[i].first.Before(files.pending[j].first)
+    })
+    return files, nil
+}
+
+func (files *Files) Next() *pcap.Packet {
+    if atomic.LoadInt32(&files.broken) != 0 {
+        return nil
+    }
+    for {
+        oldest := files.oldest()
+        if len(files.pending) > 0 &&
+            (oldest < 0 || !files.pending[0].first.After(files.open[oldest].next.Time)) {
+            files.openNext()
+            continue
+        }
+        if oldest < 0 {
+            return nil
+        }
+        head := files.open[oldest]
+        pkt := head.next
+        if head.next = head.source.Next(); head.next == nil {
+            files.closeHead(oldest)
+        }
+        return pkt
+    }
+}
+
+// oldest is the index of the open file with the oldest next packet
+func (files *Files) oldest() int {
+    oldest := -1
+    for index, head := range files.open {
+        if oldest < 0 || head.next.Time.Before(files.open[oldest].next.Time) {
+            oldest = index
+        }
+    }
+    return oldest
+}
+
+func (files *Files) openNext() {
+    start := files.pending[0]
+    files.pending = files.pending[1:]
+    source, err := offlineFile(with(files.config, "filename", start.name))
+    if err != nil {
+        fmt.Printf("%s: %s\n", start.name, err)
+        return
+    }
+    head := &fileHead{name: start.name, source: source, next: source.Next()}
+    if head.next == nil {
+        source.Close()
+        return
+    }
+    files.open = append(files.open, head)
+    if files.config["debug"] == "true" {
+        fmt.Printf("reading %s, %d files open\n", start.name, len(files.open))
+    }
+}
+
+func (files *Files) closeHead(index int) {
+    head := files.open[index]
+    if err := head.source.Err(); err != nil {
+        fmt.Printf("%s: %s\n", head.name, err)
+        if files.err == nil {
+            files.err = fmt.Errorf("%s: %s", head.name, err)
+        }
+    }
+    if stats, err := head.source.Stats(); err == nil {
+        files.closed.Received += stats.Received
+        files.closed.Dropped += stats.Dropped
+        files.closed.IfDropped += stats.IfDropped
+    }
+    head.source.Close()
+    files.open = append(files.open[:index], files.open[index+1:]...)
+}
+
+// Close closes the open files, the pending ones are dropped
+func (files *Files) Close() {
+    for len(files.open) > 0 {
+        if next := files.open[0].next; next != nil {
+            next.Release()
+        }
+        files.closeHead(0)
+    }
+    files.pending = nil
+}
+
+// Breakloop makes Next return nil, from another goroutine
+func (files *Files) Breakloop() {
+    atomic.StoreInt32(&files.broken, 1)
+}
+
+func (files *Files) Err() error {
+    return files.err
+}
+
+// Stats sums the counters of the files read so far
+func (files *Files) Stats() (*pcap.Stats, error) {
+    total := files.closed
+    for _, head := range files.open {
+        stats, err := head.source.Stats()
+        if err != nil {
+            return nil, err
+        }
+        total.Received += stats.Received
+        total.Dropped += stats.Dropped
+        total.IfDropped += stats.IfDropped
+    }
+    return &total, nil
+}
+
+// LinkType is the one of the first file, the packets carry their own
+func (files *Files) LinkType() int {
+    return files.linktype
+}
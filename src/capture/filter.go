@@ -0,0 +1,47 @@
+package capture
+
+import (
+    "fmt"
+
+    "pcap"
+)
+
+// Filter drops the packets not matching a BPF expression, for the
+// sources which cannot filter by themselves
+type Filter struct {
+    PacketSource
+    bpf      *pcap.BPF
+    Filtered uint64
+}
+
+func NewFilter(source PacketSource, expr string) (*Filter, error) {
+    linktype := source.LinkType()
+    if linktype < 0 {
+        linktype = pcap.LINKTYPE_ETHERNET
+    }
+    bpf, err := pcap.Compile(linktype, 65535, expr)
+    if err != nil {
+        return nil, filterError(expr, err)
+    }
+    return &Filter{PacketSource: source, bpf: bpf}, nil
+}
+
+func (filter *Filter) Next() *pcap.Packet {
+    for pkt := filter.PacketSource.Next(); pkt != nil; pkt = filter.PacketSource.Next() {
+        if pkt.LinkType == filter.bpf.LinkType() && filter.bpf.Match(pkt) {
+            return pkt
+        }
+        filter.Filtered++
+        pkt.Release()
+    }
+    return nil
+}
+
+func (filter *Filter) Close() {
+    filter.PacketSource.Close()
+    filter.bpf.Free()
+}
+
+func filterError(expr string, err error) error {
+    return fmt.Errorf("filter expression %q rejected: %s", expr, err)
+}
@@ -0,0 +1,272 @@
+package capture
+
+import (
+    "encoding/binary"
+    "fmt"
+    "math/rand"
+    "strconv"
+    "sync/atomic"
+    "time"
+
+    "pcap"
+)
+
+const (
+    GEN_MSS = 1460
+    // timestamp spacing when the generator is not paced
+    GEN_VIRTUAL_RATE = 100000
+
+    TCP_FIN = 0x01
+    TCP_SYN = 0x02
+    TCP_PSH = 0x08
+    TCP_ACK = 0x10
+
+    GEN_HEADERS = 14 + 20 + 20 // Ethernet, IPv4, TCP without options
+)
+
+// one TCP segment of a generated flow
+type genSegment struct {
+    client  bool // sent by the client
+    flags   uint16
+    payload int
+}
+
+// a generated connection: handshake, a request, a response acked every
+// other segment, and the teardown
+type genFlow struct {
+    clientIp, serverIp     uint32
+    clientPort, serverPort uint16
+    clientSeq, serverSeq   uint32
+    segments               []genSegment
+}
+
+// Generator makes up Ethernet/IPv4/TCP traffic, no NIC nor file needed.
+// It opens config["generate"] flows, config["genconc"] at a time, with
+// responses of config["gensize"] bytes on average, at config["genrate"]
+// packets per second (0 for as fast as possible). config["genseed"]
+// gives the same traffic again. What was generated is counted, to be
+// checked against the CSV totals.
+type Generator struct {
+    rnd      *rand.Rand
+    flows    int
+    size     int
+    rate     int
+    interval time.Duration
+    start    time.Time
+    active   []*genFlow
+    started  int
+    broken   int32
+
+    Flows   uint64 // flows finished
+    Packets uint64 // atomic
+    Bytes   uint64 // IPv4 total lengths, the frames are not padded
+}
+
+func NewGenerator(config map[string]string) (*Generator, error) {
+    values := map[string]int{"generate": 0, "genconc": 100, "gensize": 20000, "genrate": 0, "genseed": 1}
+    for key := range values {
+        if config[key] == "" {
+            continue
+        }
+        value, err := strconv.Atoi(config[key])
+        if err != nil || value < 0 {
+            return nil, fmt.Errorf("bad %s %q", key, config[key])
+        }
+        values[key] = value
+    }
+    if values["generate"] < 1 || values["genconc"] < 1 {
+        return nil, fmt.Errorf("bad generator: %d flows, %d at a time", values["generate"], values["genconc"])
+    }
+    gen := &Generator{
+        rnd:   rand.New(rand.NewSource(int64(values["genseed"]))),
+        flows: values["generate"],
+        size:  values["gensize"],
+        rate:  values["genrate"],
+        start: time.Now(),
+    }
+    if gen.rate > 0 {
+        gen.interval = time.Second / time.Duration(gen.rate)
+    } else {
+        gen.interval = time.Second / GEN_VIRTUAL_RATE
+    }
+    for len(gen.active) < values["genconc"] && gen.started < gen.flows {
+        gen.active = append(gen.active, gen.newFlow())
+    }
+    return gen, nil
+}
+
+func (gen *Generator) newFlow() *genFlow {
+    gen.started++
+    flow := &genFlow{
+        clientIp:   0x0A000000 | uint32(gen.rnd.Intn(1<<16)),
+        serverIp:   0xC0A80000 | uint32(1+gen.rnd.Intn(16)),
+        clientPort: uint16(1024 + gen.rnd.Intn(64512)),
+        serverPort: []uint16{80, 443}[gen.rnd.Intn(2)],
+        clientSeq:  gen.rnd.Uint32(),
+        serverSeq:  gen.rnd.Uint32(),
+    }
+    segments := []genSegment{
+        {true, TCP_SYN, 0},
+        {false, TCP_SYN | TCP_ACK, 0},
+        {true, TCP_ACK, 0},
+    }
+    segments = appendData(segments, true, 100+gen.rnd.Intn(900))
+    // response sizes follow an exponential law, most are small
+    segments = appendData(segments, false, int(gen.rnd.ExpFloat64()*float64(gen.size)))
+    segments = append(segments,
+        genSegment{true, TCP_FIN | TCP_ACK, 0},
+        genSegment{false, TCP_FIN | TCP_ACK, 0},
+        genSegment{true, TCP_ACK, 0})
+    flow.segments = segments
+    return flow
+}
+
+// appendData sends size bytes in MSS segments, the peer acks every
+// other segment and the last one
+func appendData(segments []genSegment, client bool, size int) []genSegment {
+    for count := 1; size > 0; count++ {
+        payload := size
+        if payload > GEN_MSS {
+            payload = GEN_MSS
+        }
+        size -= payload
+        flags := uint16(TCP_ACK)
+        if size == 0 {
+            flags |= TCP_PSH
+        }
+        segments = append(segments, genSegment{client, flags, payload})
+        if count%2 == 0 || size == 0 {
+            segments = append(segments, genSegment{!client, TCP_ACK, 0})
+        }
+    }
+    return segments
+}
+
+func (gen *Generator) Next() *pcap.Packet {
+    if atomic.LoadInt32(&gen.broken) != 0 || len(gen.active) == 0 {
+        return nil
+    }
+    count := atomic.LoadUint64(&gen.Packets)
+    t := gen.start.Add(time.Duration(count) * gen.interval)
+    if gen.rate > 0 {
+        if wait := time.Until(t); wait > 0 {
+            time.Sleep(wait)
+        }
+    }
+
+    index := gen.rnd.Intn(len(gen.active))
+    flow := gen.active[index]
+    pkt := gen.build(flow, flow.segments[0], t)
+    if flow.segments = flow.segments[1:]; len(flow.segments) == 0 {
+        gen.Flows++
+        if gen.started < gen.flows {
+            gen.active[index] = gen.newFlow()
+        } else {
+            gen.active = append(gen.active[:index], gen.active[index+1:]...)
+        }
+    }
+    return pkt
+}
+
+func (gen *Generator) build(flow *genFlow, segment genSegment, t time.Time) *pcap.Packet {
+    length := GEN_HEADERS + segment.payload
+    pkt := pcap.NewPacket(uint32(length))
+    pkt.Len = uint32(length)
+    pkt.Time = t
+    pkt.LinkType = pcap.LINKTYPE_ETHERNET
+    data := pkt.Data
+    clear(data)
+
+    srcIp, dstIp := flow.clientIp, flow.serverIp
+    srcPort, dstPort := flow.clientPort, flow.serverPort
+    seq, ack := &flow.clientSeq, &flow.serverSeq
+    if !segment.client {
+        srcIp, dstIp = dstIp, srcIp
+        srcPort, dstPort = dstPort, srcPort
+        seq, ack = ack, seq
+    }
+
+    // Ethernet, the MACs made from the addresses
+    putMac(data[0:6], dstIp)
+    putMac(data[6:12], srcIp)
+    binary.BigEndian.PutUint16(data[12:14], 0x0800)
+
+    ip := data[14:34]
+    ip[0] = 0x45
+    binary.BigEndian.PutUint16(ip[2:4], uint16(length-14))
+    binary.BigEndian.PutUint16(ip[4:6], uint16(atomic.LoadUint64(&gen.Packets)))
+    binary.BigEndian.PutUint16(ip[6:8], 0x4000) // don't fragment
+    ip[8] = 64
+    ip[9] = 6
+    binary.BigEndian.PutUint32(ip[12:16], srcIp)
+    binary.BigEndian.PutUint32(ip[16:20], dstIp)
+    binary.BigEndian.PutUint16(ip[10:12], ^checksum(0, ip))
+
+    tcp := data[34:]
+    binary.BigEndian.PutUint16(tcp[0:2], srcPort)
+    binary.BigEndian.PutUint16(tcp[2:4], dstPort)
+    binary.BigEndian.PutUint32(tcp[4:8], *seq)
+    if segment.flags&TCP_ACK != 0 {
+        binary.BigEndian.PutUint32(tcp[8:12], *ack)
+    }
+    binary.BigEndian.PutUint16(tcp[12:14], 5<<12|segment.flags)
+    binary.BigEndian.PutUint16(tcp[14:16], 65535)
+    // pseudo header, then the segment
+    sum := uint32(checksum(0, ip[12:20])) + 6 + uint32(len(tcp))
+    binary.BigEndian.PutUint16(tcp[16:18], ^checksum(sum, tcp))
+
+    *seq += uint32(segment.payload)
+    if segment.flags&(TCP_SYN|TCP_FIN) != 0 {
+        *seq++
+    }
+
+    atomic.AddUint64(&gen.Packets, 1)
+    gen.Bytes += uint64(length - 14)
+    return pkt
+}
+
+func putMac(mac []byte, ip uint32) {
+    mac[0], mac[1] = 0x02, 0x00 // locally administered
+    binary.BigEndian.PutUint32(mac[2:6], ip)
+}
+
+// checksum folds the one's complement sum of data into sum
+func checksum(sum uint32, data []byte) uint16 {
+    for i := 0; i+1 < len(data); i += 2 {
+        sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+    }
+    if len(data)%2 == 1 {
+        sum += uint32(data[len(data)-1]) << 8
+    }
+    for sum>>16 != 0 {
+        sum = sum&0xFFFF + sum>>16
+    }
+    return uint16(sum)
+}
+
+// Breakloop makes Next return nil, from another goroutine
+func (gen *Generator) Breakloop() {
+    atomic.StoreInt32(&gen.broken, 1)
+}
+
+func (gen *Generator) Err() error {
+    return nil
+}
+
+func (gen *Generator) Close() {
+    gen.active = nil
+}
+
+func (gen *Generator) Stats() (*pcap.Stats, error) {
+    return &pcap.Stats{Received: atomic.LoadUint64(&gen.Packets)}, nil
+}
+
+func (gen *Generator) LinkType() int {
+    return pcap.LINKTYPE_ETHERNET
+}
+
+// Totals is what the CSV rows should add up to
+func (gen *Generator) Totals() string {
+    return fmt.Sprintf("flows=%d pkts=%d bytes=%d",
+        gen.Flows, atomic.LoadUint64(&gen.Packets), gen.Bytes)
+}
@@ -0,0 +1,218 @@
+package capture
+
+import (
+    "time"
+
+    "pcap"
+)
+
+const (
+    // how long Merge waits for a quiet source before going on without it
+    MERGE_DELAY = 200 * time.Millisecond
+)
+
+// Named tags the packets of a source with its interface name
+type Named struct {
+    PacketSource
+    Name string
+}
+
+func (named *Named) Next() *pcap.Packet {
+    pkt := named.PacketSource.Next()
+    if pkt != nil {
+        pkt.Iface = named.Name
+    }
+    return pkt
+}
+
+type mergeItem struct {
+    index int
+    pkt   *pcap.Packet // nil when the source has nothing more to read
+}
+
+// Merge reads several live sources at once and gives their packets in
+// timestamp order. A packet goes out when every source has one queued;
+// a source quiet for MERGE_DELAY is skipped until it sends again, its
+// next packets can then be a bit late.
+type Merge struct {
+    sources []PacketSource
+    items   chan mergeItem
+    queues  [][]*pcap.Packet
+    done    []bool
+    late    []bool
+    running int
+}
+
+// NewMerge starts one reading goroutine per source
+func NewMerge(sources []PacketSource) *Merge {
+    merge := &Merge{
+        sources: sources,
+        items:   make(chan mergeItem, 1024*len(sources)),
+        queues:  make([][]*pcap.Packet, len(sources)),
+        done:    make([]bool, len(sources)),
+        late:    make([]bool, len(sources)),
+        running: len(sources),
+    }
+    for index, source := range sources {
+        go merge.read(index, source)
+    }
+    return merge
+}
+
+func (merge *Merge) read(index int, source PacketSource) {
+    for pkt := source.Next(); pkt != nil; pkt = source.Next() {
+        merge.items <- mergeItem{index, pkt}
+    }
+    merge.items <- mergeItem{index, nil}
+}
+
+// Next returns the oldest queued packet, nil once every source is done
+func (merge *Merge) Next() *pcap.Packet {
+    var timeout <-chan time.Time
+    for {
+        merge.drain()
+        if merge.ready() {
+            if pkt := merge.pop(); pkt != nil {
+                return pkt
+            }
+            if merge.running == 0 {
+                return nil
+            }
+        }
+        if timeout == nil && merge.queued() {
+            timeout = time.After(MERGE_DELAY)
+        }
+        select {
+        case item := <-merge.items:
+            merge.push(item)
+        case <-timeout:
+            for index := range merge.queues {
+                if !merge.done[index] && len(merge.queues[index]) == 0 {
+                    merge.late[index] = true
+                }
+            }
+            timeout = nil
+        }
+    }
+}
+
+// drain takes what the readers have sent, without waiting
+func (merge *Merge) drain() {
+    for {
+        select {
+        case item := <-merge.items:
+            merge.push(item)
+        default:
+            return
+        }
+    }
+}
+
+func (merge *Merge) push(item mergeItem) {
+    if item.pkt == nil {
+        merge.done[item.index] = true
+        merge.running--
+        return
+    }
+    merge.queues[item.index] = append(merge.queues[item.index], item.pkt)
+    merge.late[item.index] = false
+}
+
+// ready is true when no running source may still send an older packet
+func (merge *Merge) ready() bool {
+    for index, queue := range merge.queues {
+        if len(queue) == 0 && !merge.done[index] && !merge.late[index] {
+            return false
+        }
+    }
+    return true
+}
+
+func (merge *Merge) queued() bool {
+    for _, queue := range merge.queues {
+        if len(queue) > 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// pop removes the oldest head of the queues, nil if they are all empty
+func (merge *Merge) pop() *pcap.Packet {
+    oldest := -1
+    for index, queue := range merge.queues {
+        if len(queue) == 0 {
+            continue
+        }
+        if oldest < 0 || queue[0].Time.Before(merge.queues[oldest][0].Time) {
+            oldest = index
+        }
+    }
+    if oldest < 0 {
+        return nil
+    }
+    queue := merge.queues[oldest]
+    pkt := queue[0]
+    queue[0] = nil
+    merge.queues[oldest] = queue[1:]
+    return pkt
+}
+
+// Close stops the readers before closing the sources: a source must
+// not be closed while its reader is in Next. The packets not given
+// yet are released.
+func (merge *Merge) Close() {
+    merge.Breakloop()
+    for merge.running > 0 {
+        merge.push(<-merge.items)
+    }
+    for index, queue := range merge.queues {
+        for _, pkt := range queue {
+            pkt.Release()
+        }
+        merge.queues[index] = nil
+    }
+    for _, source := range merge.sources {
+        source.Close()
+    }
+}
+
+func (merge *Merge) Breakloop() {
+    for _, source := range merge.sources {
+        source.Breakloop()
+    }
+}
+
+// Err is the first read error of the sources
+func (merge *Merge) Err() error {
+    for _, source := range merge.sources {
+        if err := source.Err(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Stats sums the counters of the sources
+func (merge *Merge) Stats() (*pcap.Stats, error) {
+    total := new(pcap.Stats)
+    for _, source := range merge.sources {
+        stats, err := source.Stats()
+        if err != nil {
+            return nil, err
+        }
+        total.Received += stats.Received
+        total.Dropped += stats.Dropped
+        total.IfDropped += stats.IfDropped
+    }
+    return total, nil
+}
+
+// LinkType is the one of the first source, the packets carry their own
+func (merge *Merge) LinkType() int {
+    return merge.sources[0].LinkType()
+}
+
+func (merge *Merge) Sources() []PacketSource {
+    return merge.sources
+}
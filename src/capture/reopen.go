@@ -0,0 +1,167 @@
+package capture
+
+import (
+    "fmt"
+    "sync"
+    "time"
+
+    "pcap"
+)
+
+const (
+    // backoff between two attempts to reopen a device
+    REOPEN_DELAY_MIN = 500 * time.Millisecond
+    REOPEN_DELAY_MAX = 30 * time.Second
+)
+
+// Reopen reads a live device and opens it again when a read fails,
+// when the interface goes down for example, waiting longer after each
+// failed attempt. The stats live in the maps, so the flows go on.
+type Reopen struct {
+    open     func() (PacketSource, error)
+    name     string
+    mtx      sync.Mutex
+    source   PacketSource // nil while the device is down
+    closed   pcap.Stats   // counters of the handles already closed
+    broken   chan bool
+    once     sync.Once
+    Reopened uint64
+}
+
+func NewReopen(name string, open func() (PacketSource, error)) (*Reopen, error) {
+    source, err := open()
+    if err != nil {
+        return nil, err
+    }
+    return &Reopen{open: open, name: name, source: source, broken: make(chan bool)}, nil
+}
+
+func (reopen *Reopen) Next() *pcap.Packet {
+    for {
+        source := reopen.current()
+        if source == nil {
+            return nil
+        }
+        if pkt := source.Next(); pkt != nil {
+            return pkt
+        }
+        err := source.Err()
+        if err == nil || reopen.isBroken() {
+            return nil
+        }
+        fmt.Printf("%s: %s, reopening\n", reopen.name, err)
+        reopen.drop(source)
+        if !reopen.reopen() {
+            return nil
+        }
+    }
+}
+
+func (reopen *Reopen) current() PacketSource {
+    reopen.mtx.Lock()
+    defer reopen.mtx.Unlock()
+    return reopen.source
+}
+
+// drop closes a failed handle and keeps its counters
+func (reopen *Reopen) drop(source PacketSource) {
+    reopen.mtx.Lock()
+    defer reopen.mtx.Unlock()
+    if stats, err := source.Stats(); err == nil {
+        reopen.closed.Received += stats.Received
+        reopen.closed.Dropped += stats.Dropped
+        reopen.closed.IfDropped += stats.IfDropped
+    }
+    source.Close()
+    reopen.source = nil
+}
+
+// reopen tries until the device opens, false on Breakloop
+func (reopen *Reopen) reopen() bool {
+    delay := REOPEN_DELAY_MIN
+    for {
+        select {
+        case <-reopen.broken:
+            return false
+        case <-time.After(delay):
+        }
+        source, err := reopen.open()
+        if err == nil {
+            reopen.mtx.Lock()
+            defer reopen.mtx.Unlock()
+            if reopen.isBroken() {
+                source.Close()
+                return false
+            }
+            reopen.source = source
+            reopen.Reopened++
+            fmt.Printf("%s: reopened\n", reopen.name)
+            return true
+        }
+        if delay *= 2; delay > REOPEN_DELAY_MAX {
+            delay = REOPEN_DELAY_MAX
+        }
+        fmt.Printf("%s: %s, next attempt in %s\n", reopen.name, err, delay)
+    }
+}
+
+func (reopen *Reopen) isBroken() bool {
+    select {
+    case <-reopen.broken:
+        return true
+    default:
+        return false
+    }
+}
+
+// Breakloop holds the lock, drop cannot close the handle meanwhile
+func (reopen *Reopen) Breakloop() {
+    reopen.once.Do(func() { close(reopen.broken) })
+    reopen.mtx.Lock()
+    defer reopen.mtx.Unlock()
+    if reopen.source != nil {
+        reopen.source.Breakloop()
+    }
+}
+
+// Err is nil after a Breakloop, the read errors are retried
+func (reopen *Reopen) Err() error {
+    if source := reopen.current(); source != nil && !reopen.isBroken() {
+        return source.Err()
+    }
+    return nil
+}
+
+func (reopen *Reopen) Close() {
+    reopen.mtx.Lock()
+    defer reopen.mtx.Unlock()
+    if reopen.source != nil {
+        reopen.source.Close()
+    }
+}
+
+// Stats adds the counters of the closed handles to the current one
+func (reopen *Reopen) Stats() (*pcap.Stats, error) {
+    reopen.mtx.Lock()
+    defer reopen.mtx.Unlock()
+    total := reopen.closed
+    if reopen.source != nil {
+        stats, err := reopen.source.Stats()
+        if err != nil {
+            return nil, err
+        }
+        total.Received += stats.Received
+        total.Dropped += stats.Dropped
+        total.IfDropped += stats.IfDropped
+    }
+    return &total, nil
+}
+
+func (reopen *Reopen) LinkType() int {
+    reopen.mtx.Lock()
+    defer reopen.mtx.Unlock()
+    if reopen.source == nil {
+        return -1
+    }
+    return reopen.source.LinkType()
+}
@@ -0,0 +1,265 @@
+package capture
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "pcap"
+)
+
+// a -start or -end value: a time, or an offset from the first packet
+type bound struct {
+    set      bool
+    time     time.Time
+    offset   time.Duration
+    relative bool
+}
+
+// parseBound reads "+10m" or "10m" (relative), unix seconds like
+// "1700000000.5", or RFC 3339 "2023-11-14T22:13:20Z"
+func parseBound(value string) (bound, error) {
+    if value == "" {
+        return bound{}, nil
+    }
+    if offset, err := time.ParseDuration(strings.TrimPrefix(value, "+")); err == nil {
+        return bound{set: true, offset: offset, relative: true}, nil
+    }
+    if t, ok := parseUnix(value); ok {
+        return bound{set: true, time: t}, nil
+    }
+    if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+        return bound{set: true, time: t}, nil
+    }
+    return bound{}, fmt.Errorf("bad time %q: want +10m, unix seconds or 2006-01-02T15:04:05Z", value)
+}
+
+// parseUnix reads seconds.nanoseconds, as written in the CSV rows
+func parseUnix(value string) (time.Time, bool) {
+    secs, frac, _ := strings.Cut(value, ".")
+    sec, err := strconv.ParseInt(secs, 10, 64)
+    if err != nil || len(frac) > 9 {
+        return time.Time{}, false
+    }
+    var nsec uint64
+    if frac != "" {
+        if nsec, err = strconv.ParseUint(frac+strings.Repeat("0", 9-len(frac)), 10, 32); err != nil {
+            return time.Time{}, false
+        }
+    }
+    return time.Unix(sec, int64(nsec)), true
+}
+
+func (b bound) at(first time.Time) time.Time {
+    if b.relative {
+        return first.Add(b.offset)
+    }
+    return b.time
+}
+
+const (
+    LIMIT_TAKE = iota
+    LIMIT_SKIP
+    LIMIT_STOP
+)
+
+// Limits bounds what is read, by time and by count. They are shared by
+// the readers of one capture: the first packet, the count and the stop
+// are global. A live capture also stops at the end time without a
+// packet to tell it.
+type Limits struct {
+    startBound bound
+    endBound   bound
+    duration   time.Duration
+    count      uint64
+    live       bool
+
+    mtx     sync.Mutex
+    first   time.Time
+    start   time.Time // zero for none
+    end     time.Time // zero for none
+    taken   uint64
+    timer   *time.Timer
+    sources []PacketSource // of the slices, until they are closed
+    stopped bool
+}
+
+// ParseLimits reads config["start"], config["end"], config["duration"]
+// and config["count"]; nil when there is no limit
+func ParseLimits(config map[string]string) (*Limits, error) {
+    limits := &Limits{live: config["device"] != ""}
+    var err error
+    if limits.startBound, err = parseBound(config["start"]); err != nil {
+        return nil, err
+    }
+    if limits.endBound, err = parseBound(config["end"]); err != nil {
+        return nil, err
+    }
+    if value := config["duration"]; value != "" {
+        if limits.duration, err = time.ParseDuration(value); err != nil || limits.duration <= 0 {
+            return nil, fmt.Errorf("bad duration %q", value)
+        }
+    }
+    if value := config["count"]; value != "" && value != "0" {
+        if limits.count, err = strconv.ParseUint(value, 10, 64); err != nil {
+            return nil, fmt.Errorf("bad count %q", value)
+        }
+    }
+    if !limits.startBound.set && !limits.endBound.set && limits.duration == 0 && limits.count == 0 {
+        return nil, nil
+    }
+    if limits.endBound.set && !limits.endBound.relative {
+        limits.arm(limits.endBound.time)
+    }
+    return limits, nil
+}
+
+// arm stops a live capture at end, the packets may stop coming before
+func (limits *Limits) arm(end time.Time) {
+    if !limits.live {
+        return
+    }
+    if limits.timer != nil {
+        limits.timer.Stop()
+    }
+    limits.timer = time.AfterFunc(time.Until(end), limits.stop)
+}
+
+// stop makes the readers of every slice return, once
+func (limits *Limits) stop() {
+    limits.mtx.Lock()
+    defer limits.mtx.Unlock()
+    if limits.stopped {
+        return
+    }
+    limits.stopped = true
+    if limits.timer != nil {
+        limits.timer.Stop()
+    }
+    // under the lock: a slice cannot close its source meanwhile
+    for _, source := range limits.sources {
+        source.Breakloop()
+    }
+}
+
+func (limits *Limits) isStopped() bool {
+    limits.mtx.Lock()
+    defer limits.mtx.Unlock()
+    return limits.stopped
+}
+
+// watch adds the source of a slice to the ones stopped together
+func (limits *Limits) watch(source PacketSource) {
+    limits.mtx.Lock()
+    defer limits.mtx.Unlock()
+    if limits.stopped {
+        source.Breakloop()
+    }
+    limits.sources = append(limits.sources, source)
+}
+
+// forget removes a source, before it is closed
+func (limits *Limits) forget(source PacketSource) {
+    limits.mtx.Lock()
+    defer limits.mtx.Unlock()
+    for i, watched := range limits.sources {
+        if watched == source {
+            limits.sources = append(limits.sources[:i], limits.sources[i+1:]...)
+            return
+        }
+    }
+}
+
+// take tells what to do with a packet of time t
+func (limits *Limits) take(t time.Time) int {
+    limits.mtx.Lock()
+    defer limits.mtx.Unlock()
+
+    if limits.first.IsZero() {
+        limits.first = t
+        if limits.startBound.set {
+            limits.start = limits.startBound.at(t)
+        }
+        if limits.endBound.set {
+            limits.end = limits.endBound.at(t)
+        }
+        if limits.duration > 0 {
+            from := t
+            if !limits.start.IsZero() && limits.start.After(t) {
+                from = limits.start
+            }
+            if end := from.Add(limits.duration); limits.end.IsZero() || end.Before(limits.end) {
+                limits.end = end
+            }
+        }
+        if !limits.end.IsZero() && (limits.endBound.relative || limits.duration > 0) {
+            limits.arm(limits.end)
+        }
+    }
+    if !limits.end.IsZero() && !t.Before(limits.end) {
+        return LIMIT_STOP
+    }
+    if t.Before(limits.start) {
+        return LIMIT_SKIP
+    }
+    if limits.count > 0 && limits.taken >= limits.count {
+        return LIMIT_STOP
+    }
+    limits.taken++
+    return LIMIT_TAKE
+}
+
+// exhausted is true once the count is reached, no need to wait for one
+// more packet to stop
+func (limits *Limits) exhausted() bool {
+    limits.mtx.Lock()
+    defer limits.mtx.Unlock()
+    return limits.count > 0 && limits.taken >= limits.count
+}
+
+// Slice only gives the packets within the limits, and stops at the
+// first packet after them. The slices sharing the limits stop together:
+// the sources of the others are broken out of their Next.
+type Slice struct {
+    PacketSource
+    limits  *Limits
+    Skipped uint64 // packets before the start
+}
+
+func NewSlice(source PacketSource, limits *Limits) *Slice {
+    limits.watch(source)
+    return &Slice{PacketSource: source, limits: limits}
+}
+
+func (slice *Slice) Next() *pcap.Packet {
+    if slice.limits.isStopped() {
+        return nil
+    }
+    if slice.limits.exhausted() {
+        slice.limits.stop()
+        return nil
+    }
+    for pkt := slice.PacketSource.Next(); pkt != nil; pkt = slice.PacketSource.Next() {
+        switch slice.limits.take(pkt.Time) {
+        case LIMIT_TAKE:
+            return pkt
+        case LIMIT_SKIP:
+            slice.Skipped++
+            pkt.Release()
+        case LIMIT_STOP:
+            pkt.Release()
+            slice.limits.stop()
+            return nil
+        }
+    }
+    return nil
+}
+
+// Close waits for a stop in progress, the source is not broken once
+// closed
+func (slice *Slice) Close() {
+    slice.limits.forget(slice.PacketSource)
+    slice.PacketSource.Close()
+}
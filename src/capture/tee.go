@@ -0,0 +1,163 @@
+package capture
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+
+    "pcap"
+)
+
+// Tee copies the packets read from a source into a pcap file,
+// optionally only the ones matching a filter
+type Tee struct {
+    PacketSource
+    fd      *os.File
+    writer  *pcap.Writer
+    filter  *pcap.BPF
+    iface   string // only write the packets of this interface
+    Written uint64
+    Skipped uint64 // packets with another link type than the file
+}
+
+// NewTee creates the file; filter is a BPF expression or a flow
+// row, see RowFilter, and may be empty
+func NewTee(source PacketSource, file string, filter string, precision int) (*Tee, error) {
+    tee := &Tee{PacketSource: source}
+    linktype := source.LinkType()
+    if linktype < 0 {
+        linktype = pcap.LINKTYPE_ETHERNET
+    }
+
+    if filter != "" {
+        expr, iface, err := RowFilter(filter)
+        if err != nil {
+            return nil, err
+        }
+        tee.iface = iface
+        tee.filter, err = pcap.Compile(linktype, 65535, expr)
+        if err != nil {
+            return nil, fmt.Errorf("bad write filter %q: %s", expr, err)
+        }
+    }
+
+    fd, err := os.Create(file)
+    if err != nil {
+        tee.free()
+        return nil, err
+    }
+    tee.writer, err = pcap.NewWriter(fd, linktype, 65535, precision)
+    if err != nil {
+        fd.Close()
+        tee.free()
+        return nil, err
+    }
+    tee.fd = fd
+    return tee, nil
+}
+
+func (tee *Tee) Next() *pcap.Packet {
+    pkt := tee.PacketSource.Next()
+    if pkt == nil {
+        return nil
+    }
+    if pkt.LinkType != tee.writer.LinkType() {
+        tee.Skipped++
+    } else if tee.match(pkt) {
+        if err := tee.writer.WritePacket(pkt); err != nil {
+            fmt.Println("Write Error:", err)
+        } else {
+            tee.Written++
+        }
+    }
+    return pkt
+}
+
+func (tee *Tee) match(pkt *pcap.Packet) bool {
+    if tee.iface != "" && pkt.Iface != tee.iface {
+        return false
+    }
+    return tee.filter == nil || tee.filter.Match(pkt)
+}
+
+func (tee *Tee) Close() {
+    tee.PacketSource.Close()
+    tee.writer.Flush()
+    tee.fd.Close()
+    tee.free()
+}
+
+func (tee *Tee) free() {
+    if tee.filter != nil {
+        tee.filter.Free()
+        tee.filter = nil
+    }
+}
+
+// RowFilter turns the first columns of a CSV row, "ip|ip" or
+// "ip|ip|port|port" optionally after the interface column, or the
+// interface and VLAN columns of the dumps, into the BPF expression
+// matching both directions of that flow, and the interface.
+// Anything else is returned as is.
+func RowFilter(row string) (expr string, iface string, err error) {
+    if !strings.Contains(row, "|") {
+        return row, "", nil
+    }
+    fields := strings.Split(row, "|")
+    var vlans []string
+    if (len(fields) == 4 || len(fields) == 6) && net.ParseIP(fields[2]) != nil {
+        iface = fields[0]
+        if vlans, err = rowVlans(fields[1]); err != nil {
+            return "", "", fmt.Errorf("bad flow %q: %s", row, err)
+        }
+        fields = fields[2:]
+    } else if len(fields) == 3 || len(fields) == 5 {
+        iface = fields[0]
+        fields = fields[1:]
+    }
+    if len(fields) != 2 && len(fields) != 4 {
+        return "", "", fmt.Errorf("bad flow %q: want [iface|[vlan|]]ip|ip or [iface|[vlan|]]ip|ip|port|port", row)
+    }
+    for _, ip := range fields[:2] {
+        if net.ParseIP(ip) == nil {
+            return "", "", fmt.Errorf("bad flow %q: %q is not an IP", row, ip)
+        }
+    }
+    if len(fields) == 2 {
+        expr = fmt.Sprintf("host %s and host %s", fields[0], fields[1])
+    } else {
+        for _, port := range fields[2:] {
+            if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+                return "", "", fmt.Errorf("bad flow %q: %q is not a port", row, port)
+            }
+        }
+        expr = fmt.Sprintf("(src host %s and src port %s and dst host %s and dst port %s)"+
+            " or (src host %s and src port %s and dst host %s and dst port %s)",
+            fields[0], fields[2], fields[1], fields[3],
+            fields[1], fields[3], fields[0], fields[2])
+    }
+    // each vlan primitive moves the next ones past a tag
+    for i := len(vlans) - 1; i >= 0; i-- {
+        expr = fmt.Sprintf("vlan %s and (%s)", vlans[i], expr)
+    }
+    return expr, iface, nil
+}
+
+// rowVlans reads the VLAN column: empty, "100" or "100.200" for QinQ
+func rowVlans(column string) ([]string, error) {
+    if column == "" {
+        return nil, nil
+    }
+    vlans := strings.Split(column, ".")
+    if len(vlans) > 2 {
+        return nil, fmt.Errorf("%q is not a VLAN", column)
+    }
+    for _, vid := range vlans {
+        if n, err := strconv.ParseUint(vid, 10, 16); err != nil || n > 4095 {
+            return nil, fmt.Errorf("%q is not a VLAN", column)
+        }
+    }
+    return vlans, nil
+}
@@ -21,12 +21,13 @@ type clock struct {
 
 func (c *clock) Init() {
     c.mtx = new(sync.Mutex)
-    c.DumpChan = make(chan bool)
+    // one pending dump at most, Set never waits for the controler
+    c.DumpChan = make(chan bool, 1)
 }
 
 func (c *clock) Get() time.Time {
-    //	c.mtx.Lock()
-    //	defer c.mtx.Unlock()
+    c.mtx.Lock()
+    defer c.mtx.Unlock()
     return c.time
 }
 
@@ -43,7 +44,11 @@ func (c *clock) Set(t time.Time) {
     if c.last_dump.IsZero() {
         c.last_dump = t
     } else if t.Sub(c.last_dump) > DUMPPERIOD {
-        c.DumpChan <- true
+        select {
+        case c.DumpChan <- true:
+        default:
+            // a dump is already pending
+        }
         c.last_dump = t
     }
 }
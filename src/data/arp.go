@@ -0,0 +1,261 @@
+package data
+
+import (
+    "encoding/binary"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+
+    "pcap"
+    "utils"
+)
+
+const (
+    ETHERTYPE_ARP = 0x806
+
+    ARP_REQUEST = 1
+    ARP_REPLY   = 2
+
+    // a binding not seen for this long leaves the table
+    ARP_EXPIRE = time.Hour
+    // more gratuitous ARPs from one MAC in a window is a flood
+    ARP_WINDOW         = 10 * time.Second
+    ARP_GRATUITOUS_MAX = 10
+    // more IPs bound to one MAC is suspect, but for a router doing
+    // proxy ARP
+    ARP_MAC_IPS_MAX = 8
+)
+
+// alert kinds
+const (
+    ARP_ALERT_CHANGE = "binding-change"
+    ARP_ALERT_FLOOD  = "gratuitous-flood"
+    ARP_ALERT_MACIPS = "mac-many-ips"
+)
+
+// GLOBAL ARP TABLE
+var ARPTABLE *ArpTable
+
+// PACKET
+type ArpPacket struct {
+    EthPacket *pcap.Packet
+
+    Operation uint16
+    SenderMac uint64
+    SenderIp  uint32
+    TargetMac uint64
+    TargetIp  uint32
+}
+
+// Gratuitous: an announce of its own binding, asked by nobody
+func (pkt *ArpPacket) Gratuitous() bool {
+    return pkt.SenderIp == pkt.TargetIp ||
+        (pkt.Operation == ARP_REPLY && pkt.TargetMac == 0xFFFFFFFFFFFF)
+}
+
+// the same subnet can be on several VLANs of a trunk
+type arpKey struct {
+    Iface string
+    Vlan  VlanId
+    Ip    uint32
+}
+
+type ArpBinding struct {
+    Iface   string
+    Vlan    VlanId
+    Ip      uint32
+    Mac     uint64
+    Packets uint64
+    Changes uint64 // times the MAC changed
+    timeSpan
+}
+
+func (binding *ArpBinding) CSVRow() string {
+    return fmt.Sprintf("%s|%s|%s|%s|%d|%d|%s|%s\n",
+        binding.Iface, binding.Vlan, utils.EncodeIp(binding.Ip), utils.EncodeMac(binding.Mac),
+        binding.Packets, binding.Changes,
+        utils.EncodeTime(binding.FirstTime), utils.EncodeTime(binding.LastTime))
+}
+
+type ArpAlert struct {
+    Time   time.Time
+    Iface  string
+    Vlan   VlanId
+    Kind   string // ARP_ALERT_*
+    Ip     uint32
+    Mac    uint64
+    Detail string
+}
+
+func (alert *ArpAlert) CSVRow() string {
+    return fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s\n",
+        utils.EncodeTime(alert.Time), alert.Iface, alert.Vlan, alert.Kind,
+        utils.EncodeIp(alert.Ip), utils.EncodeMac(alert.Mac), alert.Detail)
+}
+
+// per MAC, for the floods and the IPs claimed
+type arpSender struct {
+    ips         map[arpKey]bool
+    window      time.Time // start of the gratuitous window
+    gratuitous  int
+    flooding    bool // alerted in this window
+    manyIpsSent bool // alerted, until the count goes down
+}
+
+// ArpTable holds the IP to MAC bindings learned from the senders of the
+// ARP packets; it lasts across the dumps, unlike the flow maps
+type ArpTable struct {
+    mtx      sync.Mutex
+    bindings map[arpKey]*ArpBinding
+    senders  map[uint64]*arpSender
+    alerts   []*ArpAlert // since the last Alerts
+}
+
+func NewArpTable() *ArpTable {
+    return &ArpTable{
+        bindings: make(map[arpKey]*ArpBinding),
+        senders:  make(map[uint64]*arpSender),
+    }
+}
+
+func (table *ArpTable) sender(mac uint64) *arpSender {
+    sender := table.senders[mac]
+    if sender == nil {
+        sender = &arpSender{ips: make(map[arpKey]bool)}
+        table.senders[mac] = sender
+    }
+    return sender
+}
+
+// forget removes a binding from its sender, and the sender with its
+// last binding
+func (table *ArpTable) forget(mac uint64, key arpKey) {
+    if sender := table.senders[mac]; sender != nil {
+        if delete(sender.ips, key); len(sender.ips) == 0 {
+            delete(table.senders, mac)
+        }
+    }
+}
+
+func (table *ArpTable) alert(alert *ArpAlert) {
+    fmt.Print("ARP alert: ", alert.CSVRow())
+    table.alerts = append(table.alerts, alert)
+}
+
+// Learn records the binding of the sender and checks it
+func (table *ArpTable) Learn(arp *ArpPacket) {
+    if arp.SenderIp == 0 {
+        // probe, the sender has no address yet
+        return
+    }
+    table.mtx.Lock()
+    defer table.mtx.Unlock()
+
+    t := arp.EthPacket.Time
+    iface := arp.EthPacket.Iface
+    vlan := LinkVlan(arp.EthPacket)
+    key := arpKey{iface, vlan, arp.SenderIp}
+    binding := table.bindings[key]
+    if binding == nil {
+        binding = &ArpBinding{Iface: iface, Vlan: vlan, Ip: arp.SenderIp, Mac: arp.SenderMac}
+        table.bindings[key] = binding
+    } else if binding.Mac != arp.SenderMac {
+        table.alert(&ArpAlert{t, iface, vlan, ARP_ALERT_CHANGE, arp.SenderIp, arp.SenderMac,
+            fmt.Sprintf("was %s", utils.EncodeMac(binding.Mac))})
+        table.forget(binding.Mac, key)
+        binding.Mac = arp.SenderMac
+        binding.Changes += 1
+    }
+    binding.Packets += 1
+    binding.timeSpan.add(t)
+
+    sender := table.sender(arp.SenderMac)
+    sender.ips[key] = true
+    if len(sender.ips) > ARP_MAC_IPS_MAX && !sender.manyIpsSent {
+        sender.manyIpsSent = true
+        table.alert(&ArpAlert{t, iface, vlan, ARP_ALERT_MACIPS, arp.SenderIp, arp.SenderMac,
+            fmt.Sprintf("%d ips", len(sender.ips))})
+    } else if len(sender.ips) <= ARP_MAC_IPS_MAX {
+        sender.manyIpsSent = false
+    }
+
+    if arp.Gratuitous() {
+        if t.Sub(sender.window) >= ARP_WINDOW {
+            sender.window = t
+            sender.gratuitous = 0
+            sender.flooding = false
+        }
+        sender.gratuitous += 1
+        if sender.gratuitous > ARP_GRATUITOUS_MAX && !sender.flooding {
+            sender.flooding = true
+            table.alert(&ArpAlert{t, iface, vlan, ARP_ALERT_FLOOD, arp.SenderIp, arp.SenderMac,
+                fmt.Sprintf("%d in %s", sender.gratuitous, ARP_WINDOW)})
+        }
+    }
+}
+
+// Bindings gives the table sorted by interface and IP, after removing
+// the bindings not seen since ARP_EXPIRE before now
+func (table *ArpTable) Bindings(now time.Time) []*ArpBinding {
+    table.mtx.Lock()
+    defer table.mtx.Unlock()
+
+    bindings := make([]*ArpBinding, 0, len(table.bindings))
+    for key, binding := range table.bindings {
+        if now.Sub(binding.LastTime) > ARP_EXPIRE {
+            delete(table.bindings, key)
+            table.forget(binding.Mac, key)
+            continue
+        }
+        copied := *binding
+        bindings = append(bindings, &copied)
+    }
+    sort.Slice(bindings, func(i, j int) bool {
+        if bindings[i].Iface != bindings[j].Iface {
+            return bindings[i].Iface < bindings[j].Iface
+        }
+        if bindings[i].Vlan != bindings[j].Vlan {
+            return bindings[i].Vlan.Less(bindings[j].Vlan)
+        }
+        return bindings[i].Ip < bindings[j].Ip
+    })
+    return bindings
+}
+
+// Alerts gives the alerts raised since the last call
+func (table *ArpTable) Alerts() []*ArpAlert {
+    table.mtx.Lock()
+    defer table.mtx.Unlock()
+    alerts := table.alerts
+    table.alerts = nil
+    return alerts
+}
+
+// ARP PARSER
+// Ethernet and IPv4 only, the others are left to the Ethernet stats
+func ParseArp(table *ArpTable, pkt *pcap.Packet, config map[string]string) {
+    data := pkt.Payload
+    if len(data) < 28 {
+        return
+    }
+    if binary.BigEndian.Uint16(data[0:2]) != ARPHRD_ETHER ||
+        binary.BigEndian.Uint16(data[2:4]) != ETHERTYPE_IPV4 ||
+        data[4] != 6 || data[5] != 4 {
+        return
+    }
+    arp := &ArpPacket{
+        EthPacket: pkt,
+        Operation: binary.BigEndian.Uint16(data[6:8]),
+        SenderMac: utils.DecodeMac(data[8:14]),
+        SenderIp:  binary.BigEndian.Uint32(data[14:18]),
+        TargetMac: utils.DecodeMac(data[18:24]),
+        TargetIp:  binary.BigEndian.Uint32(data[24:28]),
+    }
+    if arp.Operation != ARP_REQUEST && arp.Operation != ARP_REPLY {
+        return
+    }
+    if Dumps(config, "arp") {
+        table.Learn(arp)
+    }
+}
@@ -3,7 +3,6 @@ package data
 import (
     "encoding/binary"
     "fmt"
-	"strings"
 
     "pcap"
     "utils"
@@ -12,20 +11,18 @@ import (
 // GLOBAL ETH MAP
 var ETHMAP *PMap
 
-const (
-    PAYLOAD_MAX = 256
-)
-
 // MAP KEY
 type EthKey struct {
     Type   int
     SrcMac uint64
     DstMac uint64
+    Vlan   VlanId
+    Iface  string
 }
 
 func (key *EthKey) Show() string {
-    return fmt.Sprintf("Eth  src[%16x] dst[%16x] Type[%4x]",
-        key.SrcMac, key.DstMac, key.Type)
+    return fmt.Sprintf("Eth  src[%16x] dst[%16x] Type[%4x] Vlan[%s]",
+        key.SrcMac, key.DstMac, key.Type, key.Vlan)
 }
 
 func (key *EthKey) Number() uint16 {
@@ -40,7 +37,7 @@ func (key *EthKey) Serial() ISerial {
 		return *key
 //        return fmt.Sprintf("%x-%x-%x", key.SrcMac, key.DstMac, key.Type)
     }
-	return EthKey{key.Type, key.DstMac, key.SrcMac}
+	return EthKey{key.Type, key.DstMac, key.SrcMac, key.Vlan, key.Iface}
 //    return fmt.Sprintf("%x-%x-%x", key.DstMac, key.SrcMac, key.Type)
 }
 
@@ -52,6 +49,7 @@ type EthStat struct {
     PayloadSizeDst uint64
     PacketsSrc     uint64
     PacketsDst     uint64
+    timeSpan
 }
 
 func (ethstat *EthStat) Show() string {
@@ -61,12 +59,17 @@ func (ethstat *EthStat) Show() string {
 }
 
 func (ethstat *EthStat) CSVRow() string {
-    return fmt.Sprintf("%s|%s|%d|%d|%d|%d|%d\n",
+    return fmt.Sprintf("%s|%s|%s|%s|%d|%d|%d|%d|%d|%s|%s%s\n",
+        ethstat.key.Iface, ethstat.key.Vlan,
         utils.EncodeMac(ethstat.key.SrcMac),
         utils.EncodeMac(ethstat.key.DstMac),
         ethstat.key.Type,
         ethstat.PayloadSizeSrc, ethstat.PayloadSizeDst,
         ethstat.PacketsSrc, ethstat.PacketsDst,
+        utils.EncodeTime(ethstat.FirstTime), utils.EncodeTime(ethstat.LastTime),
+        SAMPLER.linkColumns(ethstat.key.Type,
+            ethstat.PayloadSizeSrc, ethstat.PayloadSizeDst,
+            ethstat.PacketsSrc, ethstat.PacketsDst),
     )
 }
 
@@ -74,7 +77,8 @@ func (ethstat *EthStat) Copy() IStat {
     return &EthStat{
         ethstat.key,
         ethstat.PayloadSizeSrc, ethstat.PayloadSizeDst,
-        ethstat.PacketsSrc, ethstat.PacketsDst}
+        ethstat.PacketsSrc, ethstat.PacketsDst,
+        ethstat.timeSpan}
 }
 
 func (ethstat *EthStat) Reset() {
@@ -82,6 +86,7 @@ func (ethstat *EthStat) Reset() {
     ethstat.PayloadSizeDst = 0
     ethstat.PacketsSrc = 0
     ethstat.PacketsDst = 0
+    ethstat.timeSpan = timeSpan{}
 }
 
 func (ethstat *EthStat) AppendStat(key IKey, pkt IPacket) {
@@ -94,34 +99,44 @@ func (ethstat *EthStat) AppendStat(key IKey, pkt IPacket) {
         ethstat.PayloadSizeDst += uint64(len(ethpkt.Payload))
         ethstat.PacketsDst += 1
     }
+    ethstat.timeSpan.add(ethpkt.Time)
 }
 
 // PACKET PARSER
+// returns nil when the frame is too short
 func ParseEthernet(ethmap *PMap, pkt *pcap.Packet, config map[string]string) *pcap.Packet {
+    if len(pkt.Data) < 14 {
+        return nil
+    }
 
     pkt.DestMac = utils.DecodeMac(pkt.Data[0:6])
     pkt.SrcMac = utils.DecodeMac(pkt.Data[6:12])
 
     ethtype := int(binary.BigEndian.Uint16(pkt.Data[12:14]))
-    vlan := -1
     shift := 0
-    if ethtype == 0x8100 {
-        // VLAN TAG
-        // TODO take last 12bits
-        vlan = int(binary.BigEndian.Uint16(pkt.Data[14:16]))
-        shift = 4
+    // VLAN TAGS
+    // stacked for QinQ, the service tag outside
+    for isVlanTag(ethtype) {
+        if len(pkt.Data) < shift+18 {
+            return nil
+        }
+        if pkt.NTags < pcap.VLAN_TAGS_MAX {
+            pkt.Tags[pkt.NTags] = decodeTag(ethtype, binary.BigEndian.Uint16(pkt.Data[shift+14:shift+16]))
+            pkt.NTags += 1
+        }
+        shift += 4
+        ethtype = int(binary.BigEndian.Uint16(pkt.Data[shift+12 : shift+14]))
     }
-    pkt.Vlan = vlan
-    pkt.Type = int(binary.BigEndian.Uint16(pkt.Data[shift+12 : shift+14]))
-
-    max_size := utils.MinInt(len(pkt.Data), PAYLOAD_MAX+1)
-    pkt.Payload = make([]byte, PAYLOAD_MAX)
-    copy(pkt.Payload, pkt.Data[shift+14:max_size])
-    pkt.Data = nil
+    pkt.Vlan = -1
+    if pkt.NTags > 0 {
+        pkt.Vlan = int(pkt.Tags[0].Vid)
+    }
+    pkt.Type = ethtype
+    setPayload(pkt, shift+14)
 
-	if strings.Contains(config["dumpproto"], "eth") {
+	if Dumps(config, "eth") && !SHEDDER.Shed(SHED_ETH) {
 		//fmt.Println(pkt.Show())
-		key := EthKey{pkt.Type, pkt.SrcMac, pkt.DestMac}
+		key := EthKey{pkt.Type, pkt.SrcMac, pkt.DestMac, LinkVlan(pkt), pkt.Iface}
 
 		is_new, chans := ethmap.InitValue(&key)
 		if is_new {
@@ -130,7 +145,8 @@ func ParseEthernet(ethmap *PMap, pkt *pcap.Packet, config map[string]string) *pc
 			stats.key = &key
 			go Handler(ethmap, &key, stats)
 		}
-		chans.Inputs <- pkt
+		pkt.Retain()
+		chans.Send(pkt)
 	}
 
     return pkt
@@ -0,0 +1,305 @@
+package data
+
+import (
+    "encoding/binary"
+    "fmt"
+    "net"
+    "strconv"
+    "time"
+
+    "utils"
+)
+
+// GLOBAL ICMP MAP, ICMP and ICMPv6
+var IcmpMAP *PMap
+
+const (
+    PROTO_ICMP   = 1
+    PROTO_TCP    = 6
+    PROTO_UDP    = 17
+    PROTO_ICMPV6 = 58
+)
+
+var icmpNames = map[uint8]string{
+    0: "echo-reply", 3: "unreachable", 4: "source-quench", 5: "redirect",
+    8: "echo-request", 9: "router-advert", 10: "router-solicit",
+    11: "time-exceeded", 12: "parameter-problem", 13: "timestamp",
+    14: "timestamp-reply",
+}
+
+var icmpv6Names = map[uint8]string{
+    1: "unreachable", 2: "packet-too-big", 3: "time-exceeded",
+    4: "parameter-problem", 128: "echo-request", 129: "echo-reply",
+    130: "mld-query", 131: "mld-report", 133: "router-solicit",
+    134: "router-advert", 135: "neighbor-solicit", 136: "neighbor-advert",
+    137: "redirect", 143: "mld2-report",
+}
+
+// IcmpQuote is the start of the packet an error refers to, as quoted
+// in the message
+type IcmpQuote struct {
+    Protocol uint8
+    SrcIp    IpAddr
+    DstIp    IpAddr
+    SrcPort  uint16 // TCP and UDP only
+    DstPort  uint16
+}
+
+func (quote *IcmpQuote) String() string {
+    // [ipv6]:port
+    src := net.JoinHostPort(quote.SrcIp.String(), strconv.Itoa(int(quote.SrcPort)))
+    dst := net.JoinHostPort(quote.DstIp.String(), strconv.Itoa(int(quote.DstPort)))
+    switch quote.Protocol {
+    case PROTO_TCP:
+        return fmt.Sprintf("tcp %s>%s", src, dst)
+    case PROTO_UDP:
+        return fmt.Sprintf("udp %s>%s", src, dst)
+    }
+    return fmt.Sprintf("proto %d %s>%s", quote.Protocol, quote.SrcIp, quote.DstIp)
+}
+
+// PACKET
+type IcmpPacket struct {
+    IpPacket IpLayer // IPv4 or IPv6
+    SrcIp    IpAddr
+    DstIp    IpAddr
+    Version  uint8 // 4 for ICMP, 6 for ICMPv6
+
+    Type     uint8
+    Code     uint8
+    Checksum uint16
+    Payload  []byte     // after the 8 bytes header
+    Quote    *IcmpQuote // errors only, nil when truncated
+}
+
+func (pkt *IcmpPacket) Show() string {
+    return fmt.Sprintf("src[%s] dst[%s] %s", pkt.SrcIp, pkt.DstIp, pkt.Describe())
+}
+
+func (pkt *IcmpPacket) GetTime() time.Time {
+    return pkt.IpPacket.GetTime()
+}
+
+func (pkt *IcmpPacket) Release() {
+    pkt.IpPacket.Release()
+}
+
+// Describe gives the version, type and code: "icmp 3/3"
+func (pkt *IcmpPacket) Describe() string {
+    if pkt.Version == 6 {
+        return fmt.Sprintf("icmp6 %d/%d", pkt.Type, pkt.Code)
+    }
+    return fmt.Sprintf("icmp %d/%d", pkt.Type, pkt.Code)
+}
+
+// IsError tells if the message quotes the packet which caused it
+func (pkt *IcmpPacket) IsError() bool {
+    if pkt.Version == 6 {
+        return pkt.Type >= 1 && pkt.Type <= 4
+    }
+    switch pkt.Type {
+    case 3, 4, 5, 11, 12:
+        return true
+    }
+    return false
+}
+
+// MAP KEY
+// one per host pair, type and code
+type IcmpKey struct {
+    SrcIp   IpAddr
+    DstIp   IpAddr
+    Version uint8
+    Type    uint8
+    Code    uint8
+    Vlan    VlanId
+    Iface   string
+}
+
+func (key *IcmpKey) Show() string {
+    return fmt.Sprintf("ICMPv%d src[%s] dst[%s] Type[%d/%d]",
+        key.Version, key.SrcIp, key.DstIp, key.Type, key.Code)
+}
+
+func (key *IcmpKey) Serial() ISerial {
+    if compareEndpoint(key.SrcIp[:], nil, key.DstIp[:], nil) <= 0 {
+        return *key
+    }
+    return IcmpKey{key.DstIp, key.SrcIp, key.Version, key.Type, key.Code, key.Vlan, key.Iface}
+}
+
+func (key *IcmpKey) Name() string {
+    names := icmpNames
+    if key.Version == 6 {
+        names = icmpv6Names
+    }
+    if name, ok := names[key.Type]; ok {
+        return name
+    }
+    return "unknown"
+}
+
+// STATS
+type IcmpStat struct {
+    key            *IcmpKey
+    PacketsSrc     uint64
+    PacketsDst     uint64
+    PayloadSizeSrc uint64
+    PayloadSizeDst uint64
+    LastQuote      string // the last flow an error referred to
+    timeSpan
+}
+
+func (icmpstat *IcmpStat) Show() string {
+    return fmt.Sprintf("Payload: %d/%d kB\tPackets: %d/%d",
+        icmpstat.PayloadSizeSrc/1024, icmpstat.PayloadSizeDst/1024,
+        icmpstat.PacketsSrc, icmpstat.PacketsDst)
+}
+
+func (icmpstat *IcmpStat) CSVRow() string {
+    return fmt.Sprintf("%s|%s|%s|%s|%d|%d|%d|%s|%d|%d|%d|%d|%s|%s|%s%s\n",
+        icmpstat.key.Iface, icmpstat.key.Vlan,
+        icmpstat.key.SrcIp, icmpstat.key.DstIp,
+        icmpstat.key.Version, icmpstat.key.Type, icmpstat.key.Code, icmpstat.key.Name(),
+        icmpstat.PayloadSizeSrc, icmpstat.PayloadSizeDst,
+        icmpstat.PacketsSrc, icmpstat.PacketsDst,
+        icmpstat.LastQuote,
+        utils.EncodeTime(icmpstat.FirstTime), utils.EncodeTime(icmpstat.LastTime),
+        SAMPLER.columns(icmpstat.PayloadSizeSrc, icmpstat.PayloadSizeDst,
+            icmpstat.PacketsSrc, icmpstat.PacketsDst))
+}
+
+func (icmpstat *IcmpStat) Copy() IStat {
+    return &IcmpStat{
+        icmpstat.key,
+        icmpstat.PacketsSrc, icmpstat.PacketsDst,
+        icmpstat.PayloadSizeSrc, icmpstat.PayloadSizeDst,
+        icmpstat.LastQuote,
+        icmpstat.timeSpan}
+}
+
+func (icmpstat *IcmpStat) Reset() {
+    icmpstat.PacketsSrc = 0
+    icmpstat.PacketsDst = 0
+    icmpstat.PayloadSizeSrc = 0
+    icmpstat.PayloadSizeDst = 0
+    icmpstat.LastQuote = ""
+    icmpstat.timeSpan = timeSpan{}
+}
+
+func (icmpstat *IcmpStat) AppendStat(key IKey, pkt IPacket) {
+    icmpkey := key.(*IcmpKey)
+    icmppkt := pkt.(*IcmpPacket)
+    if icmppkt.SrcIp == icmpkey.SrcIp {
+        icmpstat.PayloadSizeSrc += icmppkt.IpPacket.TotalLength()
+        icmpstat.PacketsSrc += 1
+    } else {
+        icmpstat.PayloadSizeDst += icmppkt.IpPacket.TotalLength()
+        icmpstat.PacketsDst += 1
+    }
+    if icmppkt.Quote != nil {
+        icmpstat.LastQuote = icmppkt.Quote.String()
+    }
+    icmpstat.timeSpan.add(icmppkt.GetTime())
+}
+
+// ICMP PARSER
+// ICMP over IPv4, ICMPv6 over IPv6; the errors also go to the TCP or
+// UDP flow they quote, when it is known
+func IcmpParser(icmpmap *PMap, pkt IpLayer, version uint8, config map[string]string) {
+    payload := pkt.UpperPayload()
+    if len(payload) < 8 {
+        return
+    }
+    icmp := new(IcmpPacket)
+
+    icmp.IpPacket = pkt
+    icmp.SrcIp, icmp.DstIp = pkt.Addrs()
+    icmp.Version = version
+    icmp.Type = payload[0]
+    icmp.Code = payload[1]
+    icmp.Checksum = binary.BigEndian.Uint16(payload[2:4])
+    icmp.Payload = payload[8:]
+    if icmp.IsError() {
+        icmp.Quote = parseQuote(version, icmp.Payload)
+    }
+
+    if Dumps(config, "icmp") {
+        key := IcmpKey{icmp.SrcIp, icmp.DstIp, version, icmp.Type, icmp.Code, LinkVlan(pkt.Link()), pkt.Link().Iface}
+        is_new, chans := icmpmap.InitValue(&key)
+        if is_new {
+            stats := new(IcmpStat)
+            stats.key = &key
+            go Handler(icmpmap, &key, stats)
+        }
+        pkt.Link().Retain()
+        chans.Send(icmp)
+    }
+
+    if icmp.Quote != nil {
+        correlate(icmp, LinkVlan(pkt.Link()), pkt.Link().Iface)
+    }
+}
+
+// parseQuote reads the IP header and the ports of the quoted packet
+func parseQuote(version uint8, data []byte) *IcmpQuote {
+    quote := new(IcmpQuote)
+    var upper []byte
+    if version == 4 {
+        if len(data) < 20 || data[0]>>4 != 4 {
+            return nil
+        }
+        ihl := int(data[0]&0x0F) * 4
+        if ihl < 20 || len(data) < ihl {
+            return nil
+        }
+        quote.Protocol = data[9]
+        quote.SrcIp = Ipv4Addr(binary.BigEndian.Uint32(data[12:16]))
+        quote.DstIp = Ipv4Addr(binary.BigEndian.Uint32(data[16:20]))
+        if binary.BigEndian.Uint16(data[6:8])&0x1FFF == 0 {
+            upper = data[ihl:]
+        }
+    } else {
+        if len(data) < 40 || data[0]>>4 != 6 {
+            return nil
+        }
+        inner := new(Ipv6Packet)
+        copy(quote.SrcIp[:], data[8:24])
+        copy(quote.DstIp[:], data[24:40])
+        if !inner.walkHeaders(data[6], data[40:]) {
+            return nil
+        }
+        quote.Protocol = inner.Protocol
+        if inner.FragOffset == 0 {
+            upper = inner.Payload
+        }
+    }
+    // the ports are in the 8 bytes always quoted
+    if (quote.Protocol == PROTO_TCP || quote.Protocol == PROTO_UDP) && len(upper) >= 4 {
+        quote.SrcPort = binary.BigEndian.Uint16(upper[0:2])
+        quote.DstPort = binary.BigEndian.Uint16(upper[2:4])
+    }
+    return quote
+}
+
+// correlate hands an error to the handler of the flow it quotes, which
+// counts it; no flow is created for it
+func correlate(icmp *IcmpPacket, vlan VlanId, iface string) {
+    quote := icmp.Quote
+    var chans *StatsChans
+    switch quote.Protocol {
+    case PROTO_TCP:
+        if TcpMAP != nil {
+            chans = TcpMAP.Get(&TcpKey{quote.SrcIp, quote.DstIp, quote.SrcPort, quote.DstPort, vlan, iface})
+        }
+    case PROTO_UDP:
+        if UdpMAP != nil {
+            chans = UdpMAP.Get(&UdpKey{quote.SrcIp, quote.DstIp, quote.SrcPort, quote.DstPort, vlan, iface})
+        }
+    }
+    if chans == nil {
+        return
+    }
+    icmp.IpPacket.Link().Retain()
+    chans.Send(icmp)
+}
@@ -10,10 +10,26 @@ import (
     "clock"
 )
 
+// Dumps tells if a protocol is in config["dumpproto"], a list like
+// "eth,ip,tcp"; "ipv4" is "ip"
+func Dumps(config map[string]string, proto string) bool {
+    for _, name := range strings.FieldsFunc(config["dumpproto"], func(r rune) bool {
+        return r == ',' || r == ' '
+    }) {
+        if name == proto || (name == "ipv4" && proto == "ip") {
+            return true
+        }
+    }
+    return false
+}
+
 // PACKET
 type IPacket interface {
     Show() string
     GetTime() time.Time
+    // Release gives back the reference on the captured packet,
+    // taken before sending it to a handler
+    Release()
 }
 
 // KEY
@@ -33,10 +49,59 @@ type IStat interface {
     AppendStat(IKey, IPacket)
 }
 
+// timeSpan is the time of the first and last packets of a stat. The
+// parsers run concurrently, the packets come in any order.
+type timeSpan struct {
+    FirstTime time.Time
+    LastTime  time.Time
+}
+
+func (span *timeSpan) add(t time.Time) {
+    if span.FirstTime.IsZero() || t.Before(span.FirstTime) {
+        span.FirstTime = t
+    }
+    if t.After(span.LastTime) {
+        span.LastTime = t
+    }
+}
+
 type StatsChans struct {
     Inputs  chan IPacket
     Results chan IStat
     Control chan string
+    Done    chan bool    // closed when the handler stops
+    sending sync.RWMutex // held by Send, the handler waits for it to stop
+}
+
+// Send gives a packet to the handler, or releases it when the handler
+// has stopped in the meantime
+func (chans *StatsChans) Send(packet IPacket) {
+    chans.sending.RLock()
+    defer chans.sending.RUnlock()
+    // Inputs may have room after the stop, nobody would take it
+    select {
+    case <-chans.Done:
+        packet.Release()
+        return
+    default:
+    }
+    select {
+    case chans.Inputs <- packet:
+    case <-chans.Done:
+        packet.Release()
+    }
+}
+
+// stop ends the sends to the handler; the ones in flight may still
+// queue packets, they are released
+func (chans *StatsChans) stop() {
+    close(chans.Done)
+    chans.sending.Lock()
+    defer chans.sending.Unlock()
+    for len(chans.Inputs) > 0 {
+        packet := <-chans.Inputs
+        packet.Release()
+    }
 }
 
 const (
@@ -87,19 +152,33 @@ func (pmap *PMap) Get(key IKey) *StatsChans {
 }
 
 func (pmap *PMap) Delete(key IKey) {
-    // lock := pmap.GetLock()
-    // lock.Lock()
-    // defer lock.Unlock()
-    // defer func() {
-    // 	fmt.Println("Cannot delete", key.Show())
-    // 	if x := recover(); x != nil {
-    // 		fmt.Println("run time panic:", x)
-    // 	}
-    // }()
+    lock := pmap.GetLock()
+    lock.Lock()
+    defer lock.Unlock()
     serial := key.Serial()
     delete(pmap.StatsChans, serial)
 }
 
+// Snapshot lists the handlers of the moment, so that dumps can talk
+// to them while the parsers keep adding new ones
+func (pmap *PMap) Snapshot() []*StatsChans {
+    lock := pmap.GetLock()
+    lock.Lock()
+    defer lock.Unlock()
+    snapshot := make([]*StatsChans, 0, len(pmap.StatsChans))
+    for _, chans := range pmap.StatsChans {
+        snapshot = append(snapshot, chans)
+    }
+    return snapshot
+}
+
+func (pmap *PMap) Len() int {
+    lock := pmap.GetLock()
+    lock.Lock()
+    defer lock.Unlock()
+    return len(pmap.StatsChans)
+}
+
 func (pmap *PMap) InitValue(key IKey) (bool, *StatsChans) {
     //key is a pointer
     lock := pmap.GetLock()
@@ -117,7 +196,9 @@ func (pmap *PMap) InitValue(key IKey) (bool, *StatsChans) {
     data_chan := make(chan IPacket, 8)
     result_chan := make(chan IStat, 8)
     control_chan := make(chan string)
-    stats_chans = &StatsChans{data_chan, result_chan, control_chan}
+    done_chan := make(chan bool)
+    stats_chans = &StatsChans{Inputs: data_chan, Results: result_chan,
+        Control: control_chan, Done: done_chan}
     pmap.unsafeSet(key, stats_chans)
 
     return true, stats_chans
@@ -126,6 +207,7 @@ func (pmap *PMap) InitValue(key IKey) (bool, *StatsChans) {
 func Handler(pmap *PMap, key IKey, stats IStat) {
 
     chans := pmap.Get(key)
+    defer chans.stop()
     var lasttime time.Time
 
 MAIN:
@@ -138,9 +220,19 @@ MAIN:
             // timoutcheck = time.NewTicker(pmap.timeout)
             stats.AppendStat(key, packet)
             lasttime = packet.GetTime()
+            packet.Release()
 
         case control := <-chans.Control:
             // order is important
+            if strings.Contains(control, "<drain>") {
+                // nothing more is sent, take what is queued
+                for len(chans.Inputs) > 0 {
+                    packet := <-chans.Inputs
+                    stats.AppendStat(key, packet)
+                    lasttime = packet.GetTime()
+                    packet.Release()
+                }
+            }
             if strings.Contains(control, "<timeout>") {
                 if clock.Clock.Get().After(lasttime.Add(time.Duration(pmap.timeout))) {
                     pmap.Delete(key)
@@ -3,7 +3,7 @@ package data
 import (
     "encoding/binary"
     "fmt"
-    "strings"
+    "net"
     "time"
 
     //internal
@@ -18,15 +18,16 @@ var IPv4MAP *PMap
 type Ipv4Packet struct {
     EthPacket *pcap.Packet
 
-    IHL      uint8
-    Protocol uint8
-    Id       uint16
-    Checksum uint16
-    SrcIp    uint32
-    DstIp    uint32
-    Tos      uint8
-    Length   uint16
-    Payload  []byte
+    IHL        uint8
+    Protocol   uint8
+    Id         uint16
+    Checksum   uint16
+    SrcIp      uint32
+    DstIp      uint32
+    Tos        uint8
+    Length     uint16
+    FragOffset uint16 // in 8 bytes units, only the first fragment has the upper header
+    Payload    []byte
 }
 
 func (pkt *Ipv4Packet) Show() string {
@@ -38,11 +39,60 @@ func (pkt *Ipv4Packet) GetTime() time.Time {
     return pkt.EthPacket.Time
 }
 
+func (pkt *Ipv4Packet) Release() {
+    pkt.EthPacket.Release()
+}
+
+func (pkt *Ipv4Packet) Link() *pcap.Packet {
+    return pkt.EthPacket
+}
+
+func (pkt *Ipv4Packet) Addrs() (IpAddr, IpAddr) {
+    return Ipv4Addr(pkt.SrcIp), Ipv4Addr(pkt.DstIp)
+}
+
+func (pkt *Ipv4Packet) TotalLength() uint64 {
+    return uint64(pkt.Length)
+}
+
+func (pkt *Ipv4Packet) UpperPayload() []byte {
+    return pkt.Payload
+}
+
+// IpLayer is what the transport parsers need from IPv4 and IPv6
+type IpLayer interface {
+    IPacket
+    Link() *pcap.Packet
+    Addrs() (src IpAddr, dst IpAddr)
+    // TotalLength counts the IP headers, as the IP stats
+    TotalLength() uint64
+    // UpperPayload is the transport header and data
+    UpperPayload() []byte
+}
+
+// IpAddr holds both versions, IPv4 mapped in IPv6; comparable, it can
+// be part of a map key
+type IpAddr [16]byte
+
+func Ipv4Addr(ip uint32) IpAddr {
+    var addr IpAddr
+    addr[10], addr[11] = 0xFF, 0xFF
+    binary.BigEndian.PutUint32(addr[12:16], ip)
+    return addr
+}
+
+// String gives the dotted form for IPv4
+func (addr IpAddr) String() string {
+    return net.IP(addr[:]).String()
+}
+
 // MAP KEY
 type Ipv4Key struct {
     Protocol uint8
     SrcIp    uint32
     DstIp    uint32
+    Vlan     VlanId
+    Iface    string
 }
 
 func (key *Ipv4Key) Show() string {
@@ -56,7 +106,7 @@ func (key *Ipv4Key) Serial() ISerial {
     if key.SrcIp <= key.DstIp {
         return *key
     }
-    return Ipv4Key{key.Protocol, key.DstIp, key.SrcIp}
+    return Ipv4Key{key.Protocol, key.DstIp, key.SrcIp, key.Vlan, key.Iface}
 }
 
 // STATS
@@ -66,6 +116,7 @@ type IpStat struct {
     PacketsDst     uint64
     PayloadSizeSrc uint64
     PayloadSizeDst uint64
+    timeSpan
 }
 
 func (ipstat *IpStat) Show() string {
@@ -75,19 +126,24 @@ func (ipstat *IpStat) Show() string {
 }
 
 func (ipstat *IpStat) CSVRow() string {
-    return fmt.Sprintf("%s|%s|%d|%d|%d|%d|%d\n",
+    return fmt.Sprintf("%s|%s|%s|%s|%d|%d|%d|%d|%d|%s|%s%s\n",
+        ipstat.key.Iface, ipstat.key.Vlan,
         utils.EncodeIp(ipstat.key.SrcIp),
         utils.EncodeIp(ipstat.key.DstIp),
         ipstat.key.Protocol,
         ipstat.PayloadSizeSrc, ipstat.PayloadSizeDst,
-        ipstat.PacketsSrc, ipstat.PacketsDst)
+        ipstat.PacketsSrc, ipstat.PacketsDst,
+        utils.EncodeTime(ipstat.FirstTime), utils.EncodeTime(ipstat.LastTime),
+        SAMPLER.columns(ipstat.PayloadSizeSrc, ipstat.PayloadSizeDst,
+            ipstat.PacketsSrc, ipstat.PacketsDst))
 }
 
 func (ipstat *IpStat) Copy() IStat {
     return &IpStat{
         ipstat.key,
         ipstat.PacketsSrc, ipstat.PacketsDst,
-        ipstat.PayloadSizeSrc, ipstat.PayloadSizeDst}
+        ipstat.PayloadSizeSrc, ipstat.PayloadSizeDst,
+        ipstat.timeSpan}
 }
 
 func (ipstat *IpStat) Reset() {
@@ -95,6 +151,7 @@ func (ipstat *IpStat) Reset() {
     ipstat.PayloadSizeDst = 0
     ipstat.PacketsSrc = 0
     ipstat.PacketsDst = 0
+    ipstat.timeSpan = timeSpan{}
 }
 
 func (ipstat *IpStat) AppendStat(key IKey, pkt IPacket) {
@@ -107,10 +164,14 @@ func (ipstat *IpStat) AppendStat(key IKey, pkt IPacket) {
         ipstat.PayloadSizeDst += uint64(ippkt.Length)
         ipstat.PacketsDst += 1
     }
+    ipstat.timeSpan.add(ippkt.GetTime())
 }
 
 // IP PARSER
 func ParseIpv4(ipmap *PMap, pkt *pcap.Packet, config map[string]string) {
+    if len(pkt.Payload) < 20 {
+        return
+    }
     ip := new(Ipv4Packet)
     //fmt.Println(pkt.Payload)
 
@@ -119,16 +180,20 @@ func ParseIpv4(ipmap *PMap, pkt *pcap.Packet, config map[string]string) {
     ip.Tos = pkt.Payload[1]
     ip.Length = binary.BigEndian.Uint16(pkt.Payload[2:4])
     ip.Id = binary.BigEndian.Uint16(pkt.Payload[4:6])
+    ip.FragOffset = binary.BigEndian.Uint16(pkt.Payload[6:8]) & 0x1FFF
     ip.Protocol = pkt.Payload[9]
     ip.Checksum = binary.BigEndian.Uint16(pkt.Payload[10:12])
     ip.SrcIp = binary.BigEndian.Uint32(pkt.Payload[12:16])
     ip.DstIp = binary.BigEndian.Uint32(pkt.Payload[16:20])
 
+    if ip.IHL < 5 || int(ip.IHL)*4 > len(pkt.Payload) {
+        return
+    }
     ip.Payload = pkt.Payload[ip.IHL*4:]
 
-    key := Ipv4Key{ip.Protocol, ip.SrcIp, ip.DstIp}
+    key := Ipv4Key{ip.Protocol, ip.SrcIp, ip.DstIp, LinkVlan(pkt), pkt.Iface}
 
-    if strings.Contains(config["dumpproto"], "ip") {
+    if Dumps(config, "ip") && !SHEDDER.Shed(SHED_IP) {
         is_new, chans := ipmap.InitValue(&key)
         if is_new {
             //fmt.Println("NEW routine:", key.Show())
@@ -137,10 +202,19 @@ func ParseIpv4(ipmap *PMap, pkt *pcap.Packet, config map[string]string) {
             stats.key = &key
             go Handler(ipmap, &key, stats)
         }
-        chans.Inputs <- ip
+        pkt.Retain()
+        chans.Send(ip)
     }
 
-    if ip.Protocol == 0x6 {
-        TcpParser(TcpMAP, ip, &key, config)
+    if ip.FragOffset != 0 {
+        return
+    }
+    switch ip.Protocol {
+    case 0x6:
+        TcpParser(TcpMAP, ip, config)
+    case 0x11:
+        UdpParser(UdpMAP, ip, config)
+    case PROTO_ICMP:
+        IcmpParser(IcmpMAP, ip, 4, config)
     }
 }
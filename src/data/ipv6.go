@@ -0,0 +1,227 @@
+package data
+
+import (
+    "encoding/binary"
+    "fmt"
+    "time"
+
+    //internal
+    "pcap"
+    "utils"
+)
+
+// GLOBAL IPV6 MAP
+var IPv6MAP *PMap
+
+// extension headers walked down to the upper layer
+const (
+    IPV6_HOPOPTS  = 0
+    IPV6_ROUTING  = 43
+    IPV6_FRAGMENT = 44
+    IPV6_NONE     = 59
+    IPV6_DSTOPTS  = 60
+)
+
+// PACKET
+type Ipv6Packet struct {
+    EthPacket *pcap.Packet
+
+    TrafficClass  uint8
+    FlowLabel     uint32
+    PayloadLength uint16
+    HopLimit      uint8
+    SrcIp         IpAddr
+    DstIp         IpAddr
+    Protocol      uint8 // upper layer, after the extension headers
+    Fragment      bool  // a fragment header was found
+    FragOffset    uint16
+    FragId        [4]byte // identification of the fragmented packet
+    Payload       []byte  // upper layer header and data
+}
+
+func (pkt *Ipv6Packet) Show() string {
+    return fmt.Sprintf("src[%s] dst[%s] Protocol[%4x]",
+        pkt.SrcIp, pkt.DstIp, pkt.Protocol)
+}
+
+func (pkt *Ipv6Packet) GetTime() time.Time {
+    return pkt.EthPacket.Time
+}
+
+func (pkt *Ipv6Packet) Release() {
+    pkt.EthPacket.Release()
+}
+
+func (pkt *Ipv6Packet) Link() *pcap.Packet {
+    return pkt.EthPacket
+}
+
+func (pkt *Ipv6Packet) Addrs() (IpAddr, IpAddr) {
+    return pkt.SrcIp, pkt.DstIp
+}
+
+// TotalLength counts the fixed header, as the IPv4 length does
+func (pkt *Ipv6Packet) TotalLength() uint64 {
+    return 40 + uint64(pkt.PayloadLength)
+}
+
+func (pkt *Ipv6Packet) UpperPayload() []byte {
+    return pkt.Payload
+}
+
+// MAP KEY
+type Ipv6Key struct {
+    Protocol uint8
+    SrcIp    IpAddr
+    DstIp    IpAddr
+    Vlan     VlanId
+    Iface    string
+}
+
+func (key *Ipv6Key) Show() string {
+    return fmt.Sprintf("IPv6 src[%s] dst[%s] Protocol[%4x]",
+        key.SrcIp, key.DstIp, key.Protocol)
+}
+
+func (key *Ipv6Key) Serial() ISerial {
+    if compareEndpoint(key.SrcIp[:], nil, key.DstIp[:], nil) <= 0 {
+        return *key
+    }
+    return Ipv6Key{key.Protocol, key.DstIp, key.SrcIp, key.Vlan, key.Iface}
+}
+
+// STATS
+type Ipv6Stat struct {
+    key            *Ipv6Key
+    PacketsSrc     uint64
+    PacketsDst     uint64
+    PayloadSizeSrc uint64
+    PayloadSizeDst uint64
+    timeSpan
+}
+
+func (ipstat *Ipv6Stat) Show() string {
+    return fmt.Sprintf("Payload: %d/%d kB\tPackets: %d/%d",
+        ipstat.PayloadSizeSrc/1024, ipstat.PayloadSizeDst/1024,
+        ipstat.PacketsSrc, ipstat.PacketsDst)
+}
+
+// same columns as the IPv4 rows
+func (ipstat *Ipv6Stat) CSVRow() string {
+    return fmt.Sprintf("%s|%s|%s|%s|%d|%d|%d|%d|%d|%s|%s%s\n",
+        ipstat.key.Iface, ipstat.key.Vlan,
+        ipstat.key.SrcIp, ipstat.key.DstIp,
+        ipstat.key.Protocol,
+        ipstat.PayloadSizeSrc, ipstat.PayloadSizeDst,
+        ipstat.PacketsSrc, ipstat.PacketsDst,
+        utils.EncodeTime(ipstat.FirstTime), utils.EncodeTime(ipstat.LastTime),
+        SAMPLER.columns(ipstat.PayloadSizeSrc, ipstat.PayloadSizeDst,
+            ipstat.PacketsSrc, ipstat.PacketsDst))
+}
+
+func (ipstat *Ipv6Stat) Copy() IStat {
+    return &Ipv6Stat{
+        ipstat.key,
+        ipstat.PacketsSrc, ipstat.PacketsDst,
+        ipstat.PayloadSizeSrc, ipstat.PayloadSizeDst,
+        ipstat.timeSpan}
+}
+
+func (ipstat *Ipv6Stat) Reset() {
+    ipstat.PayloadSizeSrc = 0
+    ipstat.PayloadSizeDst = 0
+    ipstat.PacketsSrc = 0
+    ipstat.PacketsDst = 0
+    ipstat.timeSpan = timeSpan{}
+}
+
+func (ipstat *Ipv6Stat) AppendStat(key IKey, pkt IPacket) {
+    ipkey := key.(*Ipv6Key)
+    ippkt := pkt.(*Ipv6Packet)
+    if ippkt.SrcIp == ipkey.SrcIp {
+        ipstat.PayloadSizeSrc += ippkt.TotalLength()
+        ipstat.PacketsSrc += 1
+    } else {
+        ipstat.PayloadSizeDst += ippkt.TotalLength()
+        ipstat.PacketsDst += 1
+    }
+    ipstat.timeSpan.add(ippkt.GetTime())
+}
+
+// IPV6 PARSER
+func ParseIpv6(ipmap *PMap, pkt *pcap.Packet, config map[string]string) {
+    if len(pkt.Payload) < 40 {
+        return
+    }
+    ip := new(Ipv6Packet)
+
+    ip.EthPacket = pkt
+    head := binary.BigEndian.Uint32(pkt.Payload[0:4])
+    ip.TrafficClass = uint8(head >> 20)
+    ip.FlowLabel = head & 0xFFFFF
+    ip.PayloadLength = binary.BigEndian.Uint16(pkt.Payload[4:6])
+    ip.HopLimit = pkt.Payload[7]
+    copy(ip.SrcIp[:], pkt.Payload[8:24])
+    copy(ip.DstIp[:], pkt.Payload[24:40])
+    if !ip.walkHeaders(pkt.Payload[6], pkt.Payload[40:]) {
+        return
+    }
+
+    key := Ipv6Key{ip.Protocol, ip.SrcIp, ip.DstIp, LinkVlan(pkt), pkt.Iface}
+
+    if Dumps(config, "ipv6") && !SHEDDER.Shed(SHED_IP) {
+        is_new, chans := ipmap.InitValue(&key)
+        if is_new {
+            stats := new(Ipv6Stat)
+            stats.key = &key
+            go Handler(ipmap, &key, stats)
+        }
+        pkt.Retain()
+        chans.Send(ip)
+    }
+
+    // only the first fragment has the upper layer header
+    if ip.FragOffset != 0 {
+        return
+    }
+    switch ip.Protocol {
+    case 0x6:
+        TcpParser(TcpMAP, ip, config)
+    case 0x11:
+        UdpParser(UdpMAP, ip, config)
+    case PROTO_ICMPV6:
+        IcmpParser(IcmpMAP, ip, 6, config)
+    }
+}
+
+// walkHeaders follows the extension headers from next, sets Protocol
+// and Payload; false when they are truncated
+func (ip *Ipv6Packet) walkHeaders(next uint8, data []byte) bool {
+    for {
+        switch next {
+        case IPV6_HOPOPTS, IPV6_ROUTING, IPV6_DSTOPTS:
+            // length in 8 bytes units, the first 8 not counted
+            if len(data) < 8 {
+                return false
+            }
+            size := (int(data[1]) + 1) * 8
+            if len(data) < size {
+                return false
+            }
+            next, data = data[0], data[size:]
+        case IPV6_FRAGMENT:
+            if len(data) < 8 {
+                return false
+            }
+            ip.Fragment = true
+            ip.FragOffset = binary.BigEndian.Uint16(data[2:4]) >> 3
+            copy(ip.FragId[:], data[4:8])
+            next, data = data[0], data[8:]
+        default:
+            // IPV6_NONE too: nothing follows
+            ip.Protocol = next
+            ip.Payload = data
+            return true
+        }
+    }
+}
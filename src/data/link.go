@@ -0,0 +1,119 @@
+package data
+
+import (
+    "encoding/binary"
+
+    "pcap"
+    "utils"
+)
+
+const (
+    ETHERTYPE_IPV4 = 0x800
+    ETHERTYPE_IPV6 = 0x86DD
+
+    ARPHRD_ETHER = 1
+)
+
+// LINK PARSER
+// ParseLink decodes the link layer according to pkt.LinkType, then
+// pkt.Type holds the ethertype and pkt.Payload the network layer.
+// Only Ethernet frames feed the ETH map. Returns nil for unsupported
+// link types and truncated headers.
+func ParseLink(ethmap *PMap, pkt *pcap.Packet, config map[string]string) *pcap.Packet {
+    switch pkt.LinkType {
+    case pcap.LINKTYPE_ETHERNET:
+        return ParseEthernet(ethmap, pkt, config)
+    case pcap.LINKTYPE_LINUX_SLL:
+        return parseSll(pkt)
+    case pcap.LINKTYPE_LINUX_SLL2:
+        return parseSll2(pkt)
+    case pcap.LINKTYPE_NULL:
+        return parseNull(pkt, false)
+    case pcap.LINKTYPE_LOOP:
+        return parseNull(pkt, true)
+    case pcap.LINKTYPE_RAW, pcap.DLT_RAW, pcap.DLT_RAW_OPENBSD,
+        pcap.LINKTYPE_IPV4, pcap.LINKTYPE_IPV6:
+        return parseRaw(pkt)
+    }
+    return nil
+}
+
+// Linux cooked capture, 16 bytes header
+func parseSll(pkt *pcap.Packet) *pcap.Packet {
+    if len(pkt.Data) < 16 {
+        return nil
+    }
+    hatype := binary.BigEndian.Uint16(pkt.Data[2:4])
+    halen := binary.BigEndian.Uint16(pkt.Data[4:6])
+    if hatype == ARPHRD_ETHER && halen == 6 {
+        pkt.SrcMac = utils.DecodeMac(pkt.Data[6:12])
+    }
+    pkt.Vlan = -1
+    pkt.Type = int(binary.BigEndian.Uint16(pkt.Data[14:16]))
+    setPayload(pkt, 16)
+    return pkt
+}
+
+// Linux cooked capture v2, 20 bytes header
+func parseSll2(pkt *pcap.Packet) *pcap.Packet {
+    if len(pkt.Data) < 20 {
+        return nil
+    }
+    hatype := binary.BigEndian.Uint16(pkt.Data[8:10])
+    halen := pkt.Data[11]
+    if hatype == ARPHRD_ETHER && halen == 6 {
+        pkt.SrcMac = utils.DecodeMac(pkt.Data[12:18])
+    }
+    pkt.Vlan = -1
+    pkt.Type = int(binary.BigEndian.Uint16(pkt.Data[0:2]))
+    setPayload(pkt, 20)
+    return pkt
+}
+
+// BSD loopback: a 4 bytes address family, in host byte order for
+// DLT_NULL and in network byte order for DLT_LOOP
+func parseNull(pkt *pcap.Packet, loop bool) *pcap.Packet {
+    if len(pkt.Data) < 4 {
+        return nil
+    }
+    family := binary.BigEndian.Uint32(pkt.Data[0:4])
+    if !loop && family&0xFFFF0000 != 0 {
+        // written by a little endian host
+        family = binary.LittleEndian.Uint32(pkt.Data[0:4])
+    }
+    switch family {
+    case 2:
+        pkt.Type = ETHERTYPE_IPV4
+    case 10, 24, 28, 30:
+        // AF_INET6 on Linux, NetBSD/OpenBSD, FreeBSD, Darwin
+        pkt.Type = ETHERTYPE_IPV6
+    default:
+        return nil
+    }
+    pkt.Vlan = -1
+    setPayload(pkt, 4)
+    return pkt
+}
+
+// raw IP, the version gives the protocol
+func parseRaw(pkt *pcap.Packet) *pcap.Packet {
+    if len(pkt.Data) < 1 {
+        return nil
+    }
+    switch pkt.Data[0] >> 4 {
+    case 4:
+        pkt.Type = ETHERTYPE_IPV4
+    case 6:
+        pkt.Type = ETHERTYPE_IPV6
+    default:
+        return nil
+    }
+    pkt.Vlan = -1
+    setPayload(pkt, 0)
+    return pkt
+}
+
+// setPayload points Payload to what follows the link header, no copy
+func setPayload(pkt *pcap.Packet, offset int) {
+    pkt.Payload = pkt.Data[offset:]
+}
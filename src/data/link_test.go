@@ -0,0 +1,59 @@
+package data
+
+import (
+    "encoding/binary"
+    "testing"
+
+    "pcap"
+)
+
+// BENCHMARKS
+// the allocations per frame of the link parsers, the payload is sliced
+// out of the packet buffer:
+//   go test -bench . -benchmem data
+
+// an Ethernet frame with an IPv4 and TCP header
+func benchFrame() []byte {
+    frame := make([]byte, 1514)
+    copy(frame[0:12], []byte{2, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 1})
+    binary.BigEndian.PutUint16(frame[12:14], ETHERTYPE_IPV4)
+    ip := frame[14:]
+    ip[0] = 0x45
+    binary.BigEndian.PutUint16(ip[2:4], uint16(len(ip)))
+    ip[8] = 64
+    ip[9] = 6 // TCP
+    copy(ip[12:20], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+    binary.BigEndian.PutUint16(ip[20:22], 1234)
+    binary.BigEndian.PutUint16(ip[22:24], 80)
+    ip[32] = 0x50
+    return frame
+}
+
+func benchmarkParseLink(b *testing.B, release bool) {
+    frame := benchFrame()
+    // nothing dumped: the parsing alone
+    config := map[string]string{}
+    b.ReportAllocs()
+    b.SetBytes(int64(len(frame)))
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        pkt := pcap.NewPacket(uint32(len(frame)))
+        copy(pkt.Data, frame)
+        pkt.LinkType = pcap.LINKTYPE_ETHERNET
+        if ParseLink(nil, pkt, config) == nil {
+            b.Fatal("frame not parsed")
+        }
+        if release {
+            pkt.Release()
+        }
+    }
+}
+
+func BenchmarkParseLinkPooled(b *testing.B) {
+    benchmarkParseLink(b, true)
+}
+
+// the packets are left to the GC, each one is allocated again
+func BenchmarkParseLinkUnpooled(b *testing.B) {
+    benchmarkParseLink(b, false)
+}
@@ -0,0 +1,251 @@
+package data
+
+import (
+    "encoding/binary"
+    "fmt"
+    "math"
+    "strconv"
+    "sync/atomic"
+
+    "pcap"
+)
+
+// GLOBAL SAMPLER, nil when everything is parsed
+var SAMPLER *Sampler
+
+// Sampler keeps a fraction of the flows whole, chosen by a hash of
+// their 5-tuple, then 1 packet in Rate. Both are deterministic: the
+// same capture gives the same sample. The CSV rows get the scale and
+// the scaled up counters.
+type Sampler struct {
+    Rate      uint64
+    Fraction  float64
+    threshold uint64 // flows with a hash below are kept
+    count     uint64 // packets of the kept flows, atomic
+    Kept      uint64 // atomic
+    Dropped   uint64 // atomic
+}
+
+// NewSampler reads config["sample"], 1 in N packets, and
+// config["flowsample"], the fraction of the flows; nil for no sampling
+func NewSampler(config map[string]string) (*Sampler, error) {
+    sampler := &Sampler{Rate: 1, Fraction: 1}
+    var err error
+    if value := config["sample"]; value != "" {
+        sampler.Rate, err = strconv.ParseUint(value, 10, 64)
+        if err != nil || sampler.Rate < 1 {
+            return nil, fmt.Errorf("bad packet sampling %q: want 1 in N, N >= 1", value)
+        }
+    }
+    if value := config["flowsample"]; value != "" {
+        sampler.Fraction, err = strconv.ParseFloat(value, 64)
+        if err != nil || sampler.Fraction <= 0 || sampler.Fraction > 1 {
+            return nil, fmt.Errorf("bad flow sampling %q: want a fraction in ]0, 1]", value)
+        }
+    }
+    if sampler.Rate == 1 && sampler.Fraction == 1 {
+        return nil, nil
+    }
+    sampler.threshold = uint64(sampler.Fraction * (1 << 32))
+    return sampler, nil
+}
+
+// Keep tells if the packet is parsed; always true without sampler
+func (sampler *Sampler) Keep(pkt *pcap.Packet) bool {
+    if sampler == nil {
+        return true
+    }
+    if sampler.Fraction < 1 {
+        if hash, ok := flowHash(pkt); ok && uint64(hash) >= sampler.threshold {
+            atomic.AddUint64(&sampler.Dropped, 1)
+            return false
+        }
+    }
+    if sampler.Rate > 1 && (atomic.AddUint64(&sampler.count, 1)-1)%sampler.Rate != 0 {
+        atomic.AddUint64(&sampler.Dropped, 1)
+        return false
+    }
+    atomic.AddUint64(&sampler.Kept, 1)
+    return true
+}
+
+// Scale is the factor from the sampled counters to the estimates
+func (sampler *Sampler) Scale() float64 {
+    return float64(sampler.Rate) / sampler.Fraction
+}
+
+// linkScale is the Scale of the frames of an ethertype: the flow
+// sampling only drops IP packets, the others only go through the
+// packet sampling
+func (sampler *Sampler) linkScale(ethertype int) float64 {
+    if ethertype == ETHERTYPE_IPV4 || ethertype == ETHERTYPE_IPV6 {
+        return sampler.Scale()
+    }
+    return float64(sampler.Rate)
+}
+
+// columns ends the CSV rows: the scale then the scaled counters,
+// nothing without sampler
+func (sampler *Sampler) columns(counters ...uint64) string {
+    if sampler == nil {
+        return ""
+    }
+    return scaledColumns(sampler.Scale(), counters)
+}
+
+// linkColumns is columns for the rows of the frames of one ethertype
+func (sampler *Sampler) linkColumns(ethertype int, counters ...uint64) string {
+    if sampler == nil {
+        return ""
+    }
+    return scaledColumns(sampler.linkScale(ethertype), counters)
+}
+
+// mixedColumns is columns for the rows mixing ethertypes: the counters
+// are scaled up frame by frame, by their linkScale, and the scale is
+// the mean one of the packets
+func (sampler *Sampler) mixedColumns(packets uint64, scaled ...float64) string {
+    if sampler == nil {
+        return ""
+    }
+    scale := sampler.Scale()
+    if packets > 0 {
+        scale = scaled[len(scaled)-1] / float64(packets)
+    }
+    row := "|" + strconv.FormatFloat(scale, 'g', 6, 64)
+    for _, counter := range scaled {
+        row += "|" + strconv.FormatUint(uint64(math.Round(counter)), 10)
+    }
+    return row
+}
+
+func scaledColumns(scale float64, counters []uint64) string {
+    row := "|" + strconv.FormatFloat(scale, 'g', -1, 64)
+    for _, counter := range counters {
+        row += "|" + strconv.FormatUint(uint64(math.Round(float64(counter)*scale)), 10)
+    }
+    return row
+}
+
+// flowHash hashes the 5-tuple of IP packets, the same way for both
+// directions. The next fragments have no ports: they are hashed on the
+// addresses, the protocol and the IP ID, so that the fragments of a
+// datagram get the same decision. Not ok for the other packets, which
+// are always kept by the flow sampling.
+func flowHash(pkt *pcap.Packet) (uint32, bool) {
+    ethertype, offset, ok := linkOffset(pkt)
+    if !ok {
+        return 0, false
+    }
+    data := pkt.Data[offset:]
+    var src, dst, upper, id []byte
+    var proto byte
+    switch ethertype {
+    case ETHERTYPE_IPV4:
+        if len(data) < 20 {
+            return 0, false
+        }
+        proto = data[9]
+        src, dst = data[12:16], data[16:20]
+        if binary.BigEndian.Uint16(data[6:8])&0x1FFF != 0 {
+            id = data[4:6]
+        } else if size := int(data[0]&0x0F) * 4; size <= len(data) {
+            upper = data[size:]
+        }
+    case ETHERTYPE_IPV6:
+        if len(data) < 40 {
+            return 0, false
+        }
+        src, dst = data[8:24], data[24:40]
+        // a fragment header must not change the protocol
+        var ip Ipv6Packet
+        if !ip.walkHeaders(data[6], data[40:]) {
+            return 0, false
+        }
+        proto = ip.Protocol
+        if ip.FragOffset != 0 {
+            id = ip.FragId[:]
+        } else {
+            upper = ip.Payload
+        }
+    default:
+        return 0, false
+    }
+
+    var sport, dport []byte
+    if (proto == PROTO_TCP || proto == PROTO_UDP) && len(upper) >= 4 {
+        sport, dport = upper[0:2], upper[2:4]
+    }
+    // the smaller endpoint first, both directions hash alike
+    if compareEndpoint(src, sport, dst, dport) > 0 {
+        src, dst = dst, src
+        sport, dport = dport, sport
+    }
+    hash := uint32(2166136261)
+    for _, part := range [][]byte{src, sport, dst, dport, {proto}, id} {
+        for _, b := range part {
+            hash ^= uint32(b)
+            hash *= 16777619
+        }
+    }
+    return hash, true
+}
+
+func compareEndpoint(ip1, port1, ip2, port2 []byte) int {
+    for i := range ip1 {
+        if ip1[i] != ip2[i] {
+            return int(ip1[i]) - int(ip2[i])
+        }
+    }
+    for i := range port1 {
+        if port1[i] != port2[i] {
+            return int(port1[i]) - int(port2[i])
+        }
+    }
+    return 0
+}
+
+// linkOffset finds the network layer without the full ParseLink
+func linkOffset(pkt *pcap.Packet) (ethertype int, offset int, ok bool) {
+    data := pkt.Data
+    switch pkt.LinkType {
+    case pcap.LINKTYPE_ETHERNET:
+        offset = 12
+        for {
+            if len(data) < offset+2 {
+                return 0, 0, false
+            }
+            ethertype = int(binary.BigEndian.Uint16(data[offset : offset+2]))
+            if !isVlanTag(ethertype) {
+                return ethertype, offset + 2, true
+            }
+            offset += 4
+        }
+    case pcap.LINKTYPE_LINUX_SLL:
+        if len(data) < 16 {
+            return 0, 0, false
+        }
+        return int(binary.BigEndian.Uint16(data[14:16])), 16, true
+    case pcap.LINKTYPE_LINUX_SLL2:
+        if len(data) < 20 {
+            return 0, 0, false
+        }
+        return int(binary.BigEndian.Uint16(data[0:2])), 20, true
+    case pcap.LINKTYPE_NULL, pcap.LINKTYPE_LOOP:
+        offset = 4
+        fallthrough
+    case pcap.LINKTYPE_RAW, pcap.DLT_RAW, pcap.DLT_RAW_OPENBSD,
+        pcap.LINKTYPE_IPV4, pcap.LINKTYPE_IPV6:
+        // the IP version is enough
+        if len(data) <= offset {
+            return 0, 0, false
+        }
+        switch data[offset] >> 4 {
+        case 4:
+            return ETHERTYPE_IPV4, offset, true
+        case 6:
+            return ETHERTYPE_IPV6, offset, true
+        }
+    }
+    return 0, 0, false
+}
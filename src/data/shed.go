@@ -0,0 +1,113 @@
+package data
+
+import (
+    "fmt"
+    "sync/atomic"
+)
+
+// GLOBAL SHEDDER, nil when the parsers are not bounded
+var SHEDDER *Shedder
+
+// load levels, from the parsers in flight over the maximum
+const (
+    SHED_NONE   = iota
+    SHED_ETH    // >= 1/4: the Ethernet stats are not counted
+    SHED_IP     // >= 1/2: nor the IPv4 stats, the TCP flows still are
+    SHED_SAMPLE // >= 3/4: 1 packet in SHED_SAMPLE_RATE is parsed
+    SHED_DROP   // full: the packets are not parsed
+
+    SHED_SAMPLE_RATE = 8
+)
+
+// Shedder bounds the parsers in flight. On live captures, it sheds
+// work as they pile up, when the handlers do not keep up, and counts
+// what is shed. Files are not in a hurry: the reader waits for a slot.
+type Shedder struct {
+    slots chan bool // one per parser in flight
+    live  bool
+    count uint64
+
+    // what was shed since the last CSVRow, atomic
+    Dropped uint64
+    Sampled uint64
+    Eth     uint64
+    Ip      uint64
+}
+
+func NewShedder(max int, live bool) *Shedder {
+    if max <= 0 {
+        return nil
+    }
+    return &Shedder{slots: make(chan bool, max), live: live}
+}
+
+// Sheds tells if load is shed: only on live captures, files and the
+// generator just wait for the parsers
+func (shedder *Shedder) Sheds() bool {
+    return shedder != nil && shedder.live
+}
+
+func (shedder *Shedder) Level() int {
+    if shedder == nil || !shedder.live {
+        return SHED_NONE
+    }
+    inflight := len(shedder.slots)
+    if inflight >= cap(shedder.slots) {
+        return SHED_DROP
+    }
+    return inflight * 4 / cap(shedder.slots)
+}
+
+// Acquire takes a parser slot for a packet; false when the packet is
+// to be dropped
+func (shedder *Shedder) Acquire() bool {
+    if shedder == nil {
+        return true
+    }
+    if !shedder.live {
+        shedder.slots <- true
+        return true
+    }
+    if shedder.Level() == SHED_SAMPLE &&
+        atomic.AddUint64(&shedder.count, 1)%SHED_SAMPLE_RATE != 0 {
+        atomic.AddUint64(&shedder.Sampled, 1)
+        return false
+    }
+    select {
+    case shedder.slots <- true:
+        return true
+    default:
+        atomic.AddUint64(&shedder.Dropped, 1)
+        return false
+    }
+}
+
+// Release gives back the slot at the end of the parser
+func (shedder *Shedder) Release() {
+    if shedder != nil {
+        <-shedder.slots
+    }
+}
+
+// Shed tells if the stats of a layer, SHED_ETH or SHED_IP, are skipped
+func (shedder *Shedder) Shed(layer int) bool {
+    if shedder == nil || shedder.Level() < layer {
+        return false
+    }
+    switch layer {
+    case SHED_ETH:
+        atomic.AddUint64(&shedder.Eth, 1)
+    case SHED_IP:
+        atomic.AddUint64(&shedder.Ip, 1)
+    }
+    return true
+}
+
+// CSVRow gives the counters and resets them:
+// inflight|level|dropped|sampled|eth|ip
+func (shedder *Shedder) CSVRow() string {
+    return fmt.Sprintf("%d|%d|%d|%d|%d|%d\n",
+        len(shedder.slots), shedder.Level(),
+        atomic.SwapUint64(&shedder.Dropped, 0), atomic.SwapUint64(&shedder.Sampled, 0),
+        atomic.SwapUint64(&shedder.Eth, 0), atomic.SwapUint64(&shedder.Ip, 0))
+}
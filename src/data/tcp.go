@@ -3,7 +3,6 @@ package data
 import (
     "encoding/binary"
     "fmt"
-    "strings"
     "time"
 
     "utils"
@@ -14,7 +13,9 @@ var TcpMAP *PMap
 
 // PACKET
 type TcpPacket struct {
-    Ipv4Packet *Ipv4Packet
+    IpPacket IpLayer // IPv4 or IPv6
+    SrcIp    IpAddr
+    DstIp    IpAddr
 
     SrcPort    uint16
     DstPort    uint16
@@ -29,35 +30,47 @@ type TcpPacket struct {
 }
 
 func (pkt *TcpPacket) Show() string {
-    return fmt.Sprintf("src[%x-%x] dst[%x-%x] Seq[%x]",
-        pkt.Ipv4Packet.SrcIp, pkt.SrcPort,
-        pkt.Ipv4Packet.DstIp, pkt.DstPort,
+    return fmt.Sprintf("src[%s-%x] dst[%s-%x] Seq[%x]",
+        pkt.SrcIp, pkt.SrcPort,
+        pkt.DstIp, pkt.DstPort,
         pkt.Seq)
 }
 
 func (pkt *TcpPacket) GetTime() time.Time {
-    return pkt.Ipv4Packet.GetTime()
+    return pkt.IpPacket.GetTime()
+}
+
+func (pkt *TcpPacket) Release() {
+    pkt.IpPacket.Release()
 }
 
 // MAP KEY
+// the addresses of both IP versions, a flow keeps its first direction
 type TcpKey struct {
-    Ipv4Key Ipv4Key
-
+    SrcIp   IpAddr
+    DstIp   IpAddr
     SrcPort uint16
     DstPort uint16
+    Vlan    VlanId
+    Iface   string
 }
 
 func (key *TcpKey) Show() string {
-    return fmt.Sprintf("src[%x/%x] dst[%x/%x]",
-        key.Ipv4Key.SrcIp, key.Ipv4Key.DstIp,
-        key.SrcPort, key.DstPort)
+    return fmt.Sprintf("src[%s/%x] dst[%s/%x]",
+        key.SrcIp, key.SrcPort,
+        key.DstIp, key.DstPort)
 }
 
+// Serial is the same for both directions: the smaller endpoint first
 func (key *TcpKey) Serial() ISerial {
-    if key.SrcPort < key.DstPort {
+    if compareEndpoint(key.SrcIp[:], portBytes(key.SrcPort), key.DstIp[:], portBytes(key.DstPort)) <= 0 {
         return *key
     }
-    return TcpKey{key.Ipv4Key.Serial().(Ipv4Key), key.DstPort, key.SrcPort}
+    return TcpKey{key.DstIp, key.SrcIp, key.DstPort, key.SrcPort, key.Vlan, key.Iface}
+}
+
+func portBytes(port uint16) []byte {
+    return []byte{byte(port >> 8), byte(port)}
 }
 
 // STATS
@@ -67,6 +80,11 @@ type TcpStat struct {
     count_ack      uint16
     PayloadSizeSrc uint64
     PayloadSizeDst uint64
+    PacketsSrc     uint64
+    PacketsDst     uint64
+    timeSpan
+    IcmpErrors uint64 // ICMP errors quoting the flow
+    LastIcmp   string // the last one, "icmp 3/3"
 }
 
 func (tcpstat *TcpStat) Show() string {
@@ -75,19 +93,27 @@ func (tcpstat *TcpStat) Show() string {
 }
 
 func (tcpstat *TcpStat) CSVRow() string {
-    return fmt.Sprintf("%s|%s|%d|%d|%d|%d|%d|%d\n",
-        utils.EncodeIp(tcpstat.key.Ipv4Key.SrcIp),
-        utils.EncodeIp(tcpstat.key.Ipv4Key.DstIp),
+    return fmt.Sprintf("%s|%s|%s|%s|%d|%d|%d|%d|%d|%d|%d|%d|%s|%s|%d|%s%s\n",
+        tcpstat.key.Iface, tcpstat.key.Vlan,
+        tcpstat.key.SrcIp, tcpstat.key.DstIp,
         tcpstat.key.SrcPort, tcpstat.key.DstPort,
         tcpstat.PayloadSizeSrc, tcpstat.PayloadSizeDst,
-        tcpstat.count_syn, tcpstat.count_ack)
+        tcpstat.PacketsSrc, tcpstat.PacketsDst,
+        tcpstat.count_syn, tcpstat.count_ack,
+        utils.EncodeTime(tcpstat.FirstTime), utils.EncodeTime(tcpstat.LastTime),
+        tcpstat.IcmpErrors, tcpstat.LastIcmp,
+        SAMPLER.columns(tcpstat.PayloadSizeSrc, tcpstat.PayloadSizeDst,
+            tcpstat.PacketsSrc, tcpstat.PacketsDst))
 }
 
 func (tcpstat *TcpStat) Copy() IStat {
     return &TcpStat{
         tcpstat.key,
         tcpstat.count_syn, tcpstat.count_ack,
-        tcpstat.PayloadSizeSrc, tcpstat.PayloadSizeDst}
+        tcpstat.PayloadSizeSrc, tcpstat.PayloadSizeDst,
+        tcpstat.PacketsSrc, tcpstat.PacketsDst,
+        tcpstat.timeSpan,
+        tcpstat.IcmpErrors, tcpstat.LastIcmp}
 }
 
 func (tcpstat *TcpStat) Reset() {
@@ -95,42 +121,65 @@ func (tcpstat *TcpStat) Reset() {
     tcpstat.count_ack = 0
     tcpstat.PayloadSizeSrc = 0
     tcpstat.PayloadSizeDst = 0
+    tcpstat.PacketsSrc = 0
+    tcpstat.PacketsDst = 0
+    tcpstat.timeSpan = timeSpan{}
+    tcpstat.IcmpErrors = 0
+    tcpstat.LastIcmp = ""
 }
 
 func (tcpstat *TcpStat) AppendStat(key IKey, pkt IPacket) {
+    if icmp, ok := pkt.(*IcmpPacket); ok {
+        tcpstat.IcmpErrors += 1
+        tcpstat.LastIcmp = icmp.Describe()
+        return
+    }
     tcpkey := key.(*TcpKey)
     tcppkt := pkt.(*TcpPacket)
-    if tcppkt.Ipv4Packet.SrcIp == tcpkey.Ipv4Key.SrcIp {
-        tcpstat.PayloadSizeSrc += uint64(tcppkt.Ipv4Packet.Length)
+    if tcppkt.SrcIp == tcpkey.SrcIp && tcppkt.SrcPort == tcpkey.SrcPort {
+        tcpstat.PayloadSizeSrc += tcppkt.IpPacket.TotalLength()
+        tcpstat.PacketsSrc += 1
     } else {
-        tcpstat.PayloadSizeDst += uint64(tcppkt.Ipv4Packet.Length)
+        tcpstat.PayloadSizeDst += tcppkt.IpPacket.TotalLength()
+        tcpstat.PacketsDst += 1
     }
+    tcpstat.timeSpan.add(tcppkt.GetTime())
 }
 
 // TCP PARSER
-func TcpParser(tcpmap *PMap, pkt *Ipv4Packet, ipkey *Ipv4Key, config map[string]string) {
+// over IPv4 or IPv6
+func TcpParser(tcpmap *PMap, pkt IpLayer, config map[string]string) {
+    payload := pkt.UpperPayload()
+    if len(payload) < 20 {
+        return
+    }
     tcp := new(TcpPacket)
 
-    tcp.Ipv4Packet = pkt
-    tcp.SrcPort = binary.BigEndian.Uint16(pkt.Payload[0:2])
-    tcp.DstPort = binary.BigEndian.Uint16(pkt.Payload[2:4])
-    tcp.Seq = binary.BigEndian.Uint32(pkt.Payload[4:8])
-    tcp.Ack = binary.BigEndian.Uint32(pkt.Payload[8:12])
-    tcp.DataOffset = (pkt.Payload[12] & 0xF0) >> 4
-    tcp.Flags = binary.BigEndian.Uint16(pkt.Payload[12:14]) & 0x1FF
-    tcp.Window = binary.BigEndian.Uint16(pkt.Payload[14:16])
-    tcp.Checksum = binary.BigEndian.Uint16(pkt.Payload[16:18])
-    tcp.Urgent = binary.BigEndian.Uint16(pkt.Payload[18:20])
-    tcp.Payload = pkt.Payload[tcp.DataOffset*4:]
-
-    if strings.Contains(config["dumpproto"], "tcp") {
-        key := TcpKey{*ipkey, tcp.SrcPort, tcp.DstPort}
+    tcp.IpPacket = pkt
+    tcp.SrcIp, tcp.DstIp = pkt.Addrs()
+    tcp.SrcPort = binary.BigEndian.Uint16(payload[0:2])
+    tcp.DstPort = binary.BigEndian.Uint16(payload[2:4])
+    tcp.Seq = binary.BigEndian.Uint32(payload[4:8])
+    tcp.Ack = binary.BigEndian.Uint32(payload[8:12])
+    tcp.DataOffset = (payload[12] & 0xF0) >> 4
+    tcp.Flags = binary.BigEndian.Uint16(payload[12:14]) & 0x1FF
+    tcp.Window = binary.BigEndian.Uint16(payload[14:16])
+    tcp.Checksum = binary.BigEndian.Uint16(payload[16:18])
+    tcp.Urgent = binary.BigEndian.Uint16(payload[18:20])
+    if tcp.DataOffset < 5 || int(tcp.DataOffset)*4 > len(payload) {
+        return
+    }
+    tcp.Payload = payload[tcp.DataOffset*4:]
+
+    if Dumps(config, "tcp") {
+        key := TcpKey{tcp.SrcIp, tcp.DstIp, tcp.SrcPort, tcp.DstPort, LinkVlan(pkt.Link()), pkt.Link().Iface}
         is_new, chans := tcpmap.InitValue(&key)
         if is_new {
             stats := new(TcpStat)
             stats.key = &key
             go Handler(tcpmap, &key, stats)
         }
-        chans.Inputs <- tcp
+        pkt.Link().Retain()
+        chans.Send(tcp)
     }
 }
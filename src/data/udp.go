@@ -0,0 +1,188 @@
+package data
+
+import (
+    "encoding/binary"
+    "fmt"
+    "time"
+
+    "utils"
+)
+
+// GLOBAL UDP MAP
+var UdpMAP *PMap
+
+// PACKET
+type UdpPacket struct {
+    IpPacket IpLayer // IPv4 or IPv6
+    SrcIp    IpAddr
+    DstIp    IpAddr
+
+    SrcPort  uint16
+    DstPort  uint16
+    Length   uint16 // header included
+    Checksum uint16
+    Payload  []byte
+}
+
+func (pkt *UdpPacket) Show() string {
+    return fmt.Sprintf("src[%s-%x] dst[%s-%x] Length[%d]",
+        pkt.SrcIp, pkt.SrcPort,
+        pkt.DstIp, pkt.DstPort,
+        pkt.Length)
+}
+
+func (pkt *UdpPacket) GetTime() time.Time {
+    return pkt.IpPacket.GetTime()
+}
+
+func (pkt *UdpPacket) Release() {
+    pkt.IpPacket.Release()
+}
+
+// DECODERS
+// UdpDecoder parses an application protocol on top of UDP: DNS,
+// QUIC... It runs in the parser goroutine, before the packet goes to
+// the UDP stats, and must not keep pkt.
+type UdpDecoder func(pkt *UdpPacket, config map[string]string)
+
+var udpDecoders = make(map[uint16]UdpDecoder)
+
+// RegisterUdpDecoder hooks a decoder on a port, either side of the
+// flow; to be called from init, before any packet is parsed
+func RegisterUdpDecoder(port uint16, decoder UdpDecoder) {
+    udpDecoders[port] = decoder
+}
+
+// MAP KEY
+// the addresses of both IP versions, a flow keeps its first direction
+type UdpKey struct {
+    SrcIp   IpAddr
+    DstIp   IpAddr
+    SrcPort uint16
+    DstPort uint16
+    Vlan    VlanId
+    Iface   string
+}
+
+func (key *UdpKey) Show() string {
+    return fmt.Sprintf("src[%s/%x] dst[%s/%x]",
+        key.SrcIp, key.SrcPort,
+        key.DstIp, key.DstPort)
+}
+
+// Serial is the same for both directions: the smaller endpoint first
+func (key *UdpKey) Serial() ISerial {
+    if compareEndpoint(key.SrcIp[:], portBytes(key.SrcPort), key.DstIp[:], portBytes(key.DstPort)) <= 0 {
+        return *key
+    }
+    return UdpKey{key.DstIp, key.SrcIp, key.DstPort, key.SrcPort, key.Vlan, key.Iface}
+}
+
+// STATS
+type UdpStat struct {
+    key            *UdpKey
+    PacketsSrc     uint64
+    PacketsDst     uint64
+    PayloadSizeSrc uint64
+    PayloadSizeDst uint64
+    timeSpan
+    IcmpErrors uint64 // ICMP errors quoting the flow
+    LastIcmp   string // the last one, "icmp 3/3"
+}
+
+func (udpstat *UdpStat) Show() string {
+    return fmt.Sprintf("Payload: %d/%d kB\tPackets: %d/%d",
+        udpstat.PayloadSizeSrc/1024, udpstat.PayloadSizeDst/1024,
+        udpstat.PacketsSrc, udpstat.PacketsDst)
+}
+
+func (udpstat *UdpStat) CSVRow() string {
+    return fmt.Sprintf("%s|%s|%s|%s|%d|%d|%d|%d|%d|%d|%s|%s|%d|%s%s\n",
+        udpstat.key.Iface, udpstat.key.Vlan,
+        udpstat.key.SrcIp, udpstat.key.DstIp,
+        udpstat.key.SrcPort, udpstat.key.DstPort,
+        udpstat.PayloadSizeSrc, udpstat.PayloadSizeDst,
+        udpstat.PacketsSrc, udpstat.PacketsDst,
+        utils.EncodeTime(udpstat.FirstTime), utils.EncodeTime(udpstat.LastTime),
+        udpstat.IcmpErrors, udpstat.LastIcmp,
+        SAMPLER.columns(udpstat.PayloadSizeSrc, udpstat.PayloadSizeDst,
+            udpstat.PacketsSrc, udpstat.PacketsDst))
+}
+
+func (udpstat *UdpStat) Copy() IStat {
+    return &UdpStat{
+        udpstat.key,
+        udpstat.PacketsSrc, udpstat.PacketsDst,
+        udpstat.PayloadSizeSrc, udpstat.PayloadSizeDst,
+        udpstat.timeSpan,
+        udpstat.IcmpErrors, udpstat.LastIcmp}
+}
+
+func (udpstat *UdpStat) Reset() {
+    udpstat.PacketsSrc = 0
+    udpstat.PacketsDst = 0
+    udpstat.PayloadSizeSrc = 0
+    udpstat.PayloadSizeDst = 0
+    udpstat.timeSpan = timeSpan{}
+    udpstat.IcmpErrors = 0
+    udpstat.LastIcmp = ""
+}
+
+// the sizes are IP total lengths, as for TCP
+func (udpstat *UdpStat) AppendStat(key IKey, pkt IPacket) {
+    if icmp, ok := pkt.(*IcmpPacket); ok {
+        udpstat.IcmpErrors += 1
+        udpstat.LastIcmp = icmp.Describe()
+        return
+    }
+    udpkey := key.(*UdpKey)
+    udppkt := pkt.(*UdpPacket)
+    if udppkt.SrcIp == udpkey.SrcIp && udppkt.SrcPort == udpkey.SrcPort {
+        udpstat.PayloadSizeSrc += udppkt.IpPacket.TotalLength()
+        udpstat.PacketsSrc += 1
+    } else {
+        udpstat.PayloadSizeDst += udppkt.IpPacket.TotalLength()
+        udpstat.PacketsDst += 1
+    }
+    udpstat.timeSpan.add(udppkt.GetTime())
+}
+
+// UDP PARSER
+// over IPv4 or IPv6
+func UdpParser(udpmap *PMap, pkt IpLayer, config map[string]string) {
+    payload := pkt.UpperPayload()
+    if len(payload) < 8 {
+        return
+    }
+    udp := new(UdpPacket)
+
+    udp.IpPacket = pkt
+    udp.SrcIp, udp.DstIp = pkt.Addrs()
+    udp.SrcPort = binary.BigEndian.Uint16(payload[0:2])
+    udp.DstPort = binary.BigEndian.Uint16(payload[2:4])
+    udp.Length = binary.BigEndian.Uint16(payload[4:6])
+    udp.Checksum = binary.BigEndian.Uint16(payload[6:8])
+    udp.Payload = payload[8:]
+    // the IP payload can be padded, or truncated by the snaplen
+    if int(udp.Length) >= 8 && int(udp.Length) <= len(payload) {
+        udp.Payload = payload[8:udp.Length]
+    }
+
+    if decoder, ok := udpDecoders[udp.DstPort]; ok {
+        decoder(udp, config)
+    } else if decoder, ok := udpDecoders[udp.SrcPort]; ok {
+        decoder(udp, config)
+    }
+
+    if Dumps(config, "udp") {
+        key := UdpKey{udp.SrcIp, udp.DstIp, udp.SrcPort, udp.DstPort, LinkVlan(pkt.Link()), pkt.Link().Iface}
+        is_new, chans := udpmap.InitValue(&key)
+        if is_new {
+            stats := new(UdpStat)
+            stats.key = &key
+            go Handler(udpmap, &key, stats)
+        }
+        pkt.Link().Retain()
+        chans.Send(udp)
+    }
+}
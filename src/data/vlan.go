@@ -0,0 +1,174 @@
+package data
+
+import (
+    "fmt"
+    "strings"
+
+    "pcap"
+    "utils"
+)
+
+const (
+    ETHERTYPE_VLAN = 0x8100 // 802.1Q
+    ETHERTYPE_QINQ = 0x88A8 // 802.1ad, the service tag
+    // the service tag before 802.1ad, still used by some switches
+    ETHERTYPE_QINQ_OLD = 0x9100
+)
+
+// GLOBAL VLAN MAP, the summary per VLAN
+var VlanMAP *PMap
+
+func isVlanTag(ethertype int) bool {
+    return ethertype == ETHERTYPE_VLAN || ethertype == ETHERTYPE_QINQ ||
+        ethertype == ETHERTYPE_QINQ_OLD
+}
+
+func decodeTag(tpid int, tci uint16) pcap.VlanTag {
+    return pcap.VlanTag{
+        Tpid: uint16(tpid),
+        Vid:  tci & 0xFFF,
+        Pcp:  uint8(tci >> 13),
+        Dei:  tci&0x1000 != 0,
+    }
+}
+
+// VlanId is the VLAN stack of a frame as a key dimension: the outer and
+// the inner VID, -1 when there is no such tag
+type VlanId struct {
+    Outer int16
+    Inner int16
+}
+
+var NO_VLAN = VlanId{-1, -1}
+
+// LinkVlan gives the VLAN stack of a parsed frame
+func LinkVlan(pkt *pcap.Packet) VlanId {
+    vlan := NO_VLAN
+    if pkt.NTags > 0 {
+        vlan.Outer = int16(pkt.Tags[0].Vid)
+    }
+    if pkt.NTags > 1 {
+        vlan.Inner = int16(pkt.Tags[1].Vid)
+    }
+    return vlan
+}
+
+// String gives the CSV column: empty when untagged, "100" or "100.200"
+// for QinQ
+func (vlan VlanId) String() string {
+    if vlan.Outer < 0 {
+        return ""
+    }
+    if vlan.Inner < 0 {
+        return fmt.Sprintf("%d", vlan.Outer)
+    }
+    return fmt.Sprintf("%d.%d", vlan.Outer, vlan.Inner)
+}
+
+// Less sorts the untagged first, then by outer and inner VID
+func (vlan VlanId) Less(other VlanId) bool {
+    if vlan.Outer != other.Outer {
+        return vlan.Outer < other.Outer
+    }
+    return vlan.Inner < other.Inner
+}
+
+// MAP KEY
+type VlanKey struct {
+    Vlan  VlanId
+    Iface string
+}
+
+func (key *VlanKey) Show() string {
+    return fmt.Sprintf("VLAN [%s]", key.Vlan)
+}
+
+func (key *VlanKey) Serial() ISerial {
+    return *key
+}
+
+// STATS
+type VlanStat struct {
+    key     *VlanKey
+    Packets uint64
+    Bytes   uint64 // frame lengths, on the wire
+    Pcp     [8]uint64
+    Dei     uint64 // drop eligible frames
+    timeSpan
+    // bytes and packets scaled up with sampling, the frames of a VLAN
+    // are not all sampled alike
+    scaled [2]float64
+}
+
+func (vlanstat *VlanStat) Show() string {
+    return fmt.Sprintf("Bytes: %d kB\tPackets: %d",
+        vlanstat.Bytes/1024, vlanstat.Packets)
+}
+
+// the priorities seen are a list of pcp:packets, "0:120 5:8"; with
+// sampling the row ends with the mean scale, the bytes and the packets
+func (vlanstat *VlanStat) CSVRow() string {
+    pcp := make([]string, 0, len(vlanstat.Pcp))
+    for prio, packets := range vlanstat.Pcp {
+        if packets > 0 {
+            pcp = append(pcp, fmt.Sprintf("%d:%d", prio, packets))
+        }
+    }
+    return fmt.Sprintf("%s|%s|%d|%d|%s|%d|%s|%s%s\n",
+        vlanstat.key.Iface, vlanstat.key.Vlan,
+        vlanstat.Bytes, vlanstat.Packets,
+        strings.Join(pcp, " "), vlanstat.Dei,
+        utils.EncodeTime(vlanstat.FirstTime), utils.EncodeTime(vlanstat.LastTime),
+        SAMPLER.mixedColumns(vlanstat.Packets, vlanstat.scaled[:]...))
+}
+
+func (vlanstat *VlanStat) Copy() IStat {
+    copied := *vlanstat
+    return &copied
+}
+
+func (vlanstat *VlanStat) Reset() {
+    vlanstat.Packets = 0
+    vlanstat.Bytes = 0
+    vlanstat.Pcp = [8]uint64{}
+    vlanstat.Dei = 0
+    vlanstat.timeSpan = timeSpan{}
+    vlanstat.scaled = [2]float64{}
+}
+
+// the priority and the drop eligibility are the outer tag ones
+func (vlanstat *VlanStat) AppendStat(key IKey, pkt IPacket) {
+    ethpkt := pkt.(*pcap.Packet)
+    vlanstat.Packets += 1
+    vlanstat.Bytes += uint64(ethpkt.Len)
+    if ethpkt.NTags > 0 {
+        vlanstat.Pcp[ethpkt.Tags[0].Pcp] += 1
+        if ethpkt.Tags[0].Dei {
+            vlanstat.Dei += 1
+        }
+    }
+    vlanstat.timeSpan.add(ethpkt.Time)
+    if SAMPLER != nil {
+        scale := SAMPLER.linkScale(ethpkt.Type)
+        vlanstat.scaled[0] += float64(ethpkt.Len) * scale
+        vlanstat.scaled[1] += scale
+    }
+}
+
+// VLAN PARSER
+// counts every frame of the link, the untagged ones in their own row;
+// shed along with the Ethernet stats, which count the frames shed
+func ParseVlan(vlanmap *PMap, pkt *pcap.Packet, config map[string]string) {
+    if !Dumps(config, "vlan") || SHEDDER.Level() >= SHED_ETH {
+        return
+    }
+    key := VlanKey{LinkVlan(pkt), pkt.Iface}
+    is_new, chans := vlanmap.InitValue(&key)
+    if is_new {
+        stats := new(VlanStat)
+        stats.key = &key
+        go Handler(vlanmap, &key, stats)
+    }
+    pkt.Retain()
+    chans.Send(pkt)
+}
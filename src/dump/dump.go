@@ -4,89 +4,147 @@ import (
     "fmt"
     "io"
     "os"
-    "strings"
 
     // internal
     "clock"
     "data"
 )
 
-func WriteEthernet(config map[string]string, pmap *data.PMap) {
-    var fd *os.File
+// the final dumps, once the parsers are done, take the packets still
+// queued and stop the handlers
+func WriteEthernet(config map[string]string, pmap *data.PMap, final bool) {
+    if config["debug"] == "true" || final {
+        fmt.Printf("ETH routines: %d\n", pmap.Len())
+    }
+    write_pmap(pmap, "eth", data.Dumps(config, "eth"), final)
+}
 
-    if config["debug"] == "true" {
-        fmt.Printf("ETH routines: %d\n", len(pmap.StatsChans))
+func WriteIpv4(config map[string]string, pmap *data.PMap, final bool) {
+    if config["debug"] == "true" || final {
+        fmt.Printf("IP  routines: %d\n", pmap.Len())
     }
+    write_pmap(pmap, "ipv4", data.Dumps(config, "ip"), final)
+}
 
-    if strings.Contains(config["dumpproto"], "eth") {
-        fd = create_file("eth")
-        for _, chans := range data.ETHMAP.StatsChans {
-            chans.Control <- "<dump><reset><timeout>"
-            result := <-chans.Results
-            if result != nil {
-                write_stats(fd, result)
-            }
-        }
-        close_file(fd)
-    } else {
-        for _, chans := range pmap.StatsChans {
-            chans.Control <- "<timeout>"
-        }
+func WriteIpv6(config map[string]string, pmap *data.PMap, final bool) {
+    if config["debug"] == "true" || final {
+        fmt.Printf("IP6 routines: %d\n", pmap.Len())
     }
+    write_pmap(pmap, "ipv6", data.Dumps(config, "ipv6"), final)
 }
 
-func WriteIpv4(config map[string]string, pmap *data.PMap) {
-    var fd *os.File
+func WriteTcp(config map[string]string, pmap *data.PMap, final bool) {
+    if config["debug"] == "true" || final {
+        fmt.Printf("TCP routines: %d\n", pmap.Len())
+    }
+    write_pmap(pmap, "tcp", data.Dumps(config, "tcp"), final)
+}
 
-    if config["debug"] == "true" {
-        fmt.Printf("IP  routines: %d\n", len(pmap.StatsChans))
+func WriteUdp(config map[string]string, pmap *data.PMap, final bool) {
+    if config["debug"] == "true" || final {
+        fmt.Printf("UDP routines: %d\n", pmap.Len())
     }
+    write_pmap(pmap, "udp", data.Dumps(config, "udp"), final)
+}
+
+func WriteIcmp(config map[string]string, pmap *data.PMap, final bool) {
+    if config["debug"] == "true" || final {
+        fmt.Printf("ICMP routines: %d\n", pmap.Len())
+    }
+    write_pmap(pmap, "icmp", data.Dumps(config, "icmp"), final)
+}
+
+func WriteVlan(config map[string]string, pmap *data.PMap, final bool) {
+    if config["debug"] == "true" || final {
+        fmt.Printf("VLAN routines: %d\n", pmap.Len())
+    }
+    write_pmap(pmap, "vlan", data.Dumps(config, "vlan"), final)
+}
 
-    if strings.Contains(config["dumpproto"], "ip") {
-        fd = create_file("ipv4")
-        for _, chans := range pmap.StatsChans {
-            chans.Control <- "<dump><reset><timeout>"
-            result := <-chans.Results
-            if result != nil {
-                write_stats(fd, result)
-            }
+// WriteArp writes the ARP table, whole, and the alerts raised since
+// the last dump
+func WriteArp(config map[string]string, table *data.ArpTable, final bool) {
+    if !data.Dumps(config, "arp") {
+        return
+    }
+    bindings := table.Bindings(clock.Clock.Get())
+    if config["debug"] == "true" || final {
+        fmt.Printf("ARP bindings: %d\n", len(bindings))
+    }
+    fd := replace_file("arp")
+    for _, binding := range bindings {
+        write_row(fd, binding.CSVRow())
+    }
+    close_file(fd)
+    if alerts := table.Alerts(); len(alerts) > 0 {
+        fd = create_file("arpalert")
+        for _, alert := range alerts {
+            write_row(fd, alert.CSVRow())
         }
         close_file(fd)
-    } else {
-        for _, chans := range pmap.StatsChans {
-            chans.Control <- "<timeout>"
-        }
     }
 }
 
-func WriteTcp(config map[string]string, pmap *data.PMap) {
-    var fd *os.File
-
+// WriteShed writes what the parsers shed since the last dump, when
+// load is shed
+func WriteShed(config map[string]string) {
+    if !data.SHEDDER.Sheds() {
+        return
+    }
+    row := data.SHEDDER.CSVRow()
     if config["debug"] == "true" {
-        fmt.Printf("TCP routines: %d\n", len(pmap.StatsChans))
+        fmt.Print("shed (inflight|level|dropped|sampled|eth|ip): ", row)
     }
+    fd := create_file("shed")
+    write_row(fd, row)
+    close_file(fd)
+}
 
-    if strings.Contains(config["dumpproto"], "tcp") {
-        fd = create_file("tcp")
-        for _, chans := range pmap.StatsChans {
-            chans.Control <- "<dump><reset><timeout>"
-            result := <-chans.Results
-            if result != nil {
-                write_stats(fd, result)
-            }
+// write_pmap works on a snapshot of the handlers, the capture goes on
+// and new handlers will be in the next dump
+func write_pmap(pmap *data.PMap, datatype string, active bool, final bool) {
+    if !active {
+        control := "<timeout>"
+        if final {
+            control = "<kill>"
         }
-        close_file(fd)
-    } else {
-        for _, chans := range pmap.StatsChans {
-            chans.Control <- "<timeout>"
+        for _, chans := range pmap.Snapshot() {
+            chans.Control <- control
         }
+        return
+    }
+    control := "<dump><reset><timeout>"
+    if final {
+        control = "<drain><dump><kill>"
     }
+    fd := create_file(datatype)
+    for _, chans := range pmap.Snapshot() {
+        chans.Control <- control
+        result := <-chans.Results
+        if result != nil {
+            write_stats(fd, result)
+        }
+    }
+    close_file(fd)
+}
+
+func dump_filename(datatype string) string {
+    return fmt.Sprintf("dump_%s_%d.csv", datatype, clock.Clock.GetForDump())
 }
 
 func create_file(datatype string) *os.File {
-    time := clock.Clock.GetForDump()
-    filename := fmt.Sprintf("dump_%s_%d.csv", datatype, time)
-    file, ok := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0664)
+    // the final dump can fall in the period of the last one
+    return open_file(dump_filename(datatype), os.O_APPEND)
+}
+
+// replace_file is for the dumps of a whole state, the last one of a
+// period is enough
+func replace_file(datatype string) *os.File {
+    return open_file(dump_filename(datatype), os.O_TRUNC)
+}
+
+func open_file(filename string, mode int) *os.File {
+    file, ok := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|mode, 0664)
     if ok != nil {
         fmt.Println("Dump File Error:", ok)
     } else {
@@ -96,11 +154,14 @@ func create_file(datatype string) *os.File {
 }
 
 func write_stats(file *os.File, stat data.IStat) {
+    write_row(file, stat.CSVRow())
+}
+
+func write_row(file *os.File, row string) {
     if file == nil {
         return
     }
-    txt := stat.CSVRow()
-    io.WriteString(file, txt)
+    io.WriteString(file, row)
 }
 
 func close_file(file *os.File) {
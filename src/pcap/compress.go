@@ -0,0 +1,135 @@
+package pcap
+
+/* compressed savefiles, detected by their magic bytes */
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "strings"
+    "time"
+)
+
+var (
+    MAGIC_GZIP = []byte{0x1f, 0x8b}
+    MAGIC_ZSTD = []byte{0x28, 0xb5, 0x2f, 0xfd}
+    MAGIC_XZ   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// Compression names the compression of a stream from its first bytes,
+// "" when it is not compressed
+func Compression(magic []byte) string {
+    switch {
+    case bytes.HasPrefix(magic, MAGIC_GZIP):
+        return "gzip"
+    case bytes.HasPrefix(magic, MAGIC_ZSTD):
+        return "zstd"
+    case bytes.HasPrefix(magic, MAGIC_XZ):
+        return "xz"
+    }
+    return ""
+}
+
+// IsCompressed tells if file, "-" for stdin, needs Decompress; stdin
+// is reported as compressed since it can only be read once
+func IsCompressed(file string) (bool, error) {
+    if file == "-" {
+        return true, nil
+    }
+    fd, err := os.Open(file)
+    if err != nil {
+        return false, err
+    }
+    defer fd.Close()
+    magic := make([]byte, len(MAGIC_XZ))
+    n, _ := io.ReadFull(fd, magic)
+    return Compression(magic[:n]) != "", nil
+}
+
+// Decompress returns the uncompressed content of r: gzip is read in
+// process, zstd and xz through the zstd and xz commands. Closing the
+// result closes r.
+func Decompress(r io.ReadCloser) (io.ReadCloser, error) {
+    buffered := bufio.NewReaderSize(r, 1<<16)
+    magic, _ := buffered.Peek(len(MAGIC_XZ))
+    switch compression := Compression(magic); compression {
+    case "gzip":
+        gz, err := gzip.NewReader(buffered)
+        if err != nil {
+            return nil, fmt.Errorf("gzip: %s", err)
+        }
+        return &readCloser{gz, []io.Closer{gz, r}}, nil
+    case "zstd", "xz":
+        return decompressCommand(compression, buffered, r)
+    }
+    return &readCloser{buffered, []io.Closer{r}}, nil
+}
+
+type readCloser struct {
+    io.Reader
+    closers []io.Closer
+}
+
+func (rc *readCloser) Close() error {
+    var first error
+    for _, closer := range rc.closers {
+        if err := closer.Close(); err != nil && first == nil {
+            first = err
+        }
+    }
+    return first
+}
+
+// commandReader reads the output of a decompression command; a failure
+// of the command, a corrupted file, is the error of the last Read
+type commandReader struct {
+    name   string
+    cmd    *exec.Cmd
+    stdout io.ReadCloser
+    stderr bytes.Buffer
+    input  io.Closer
+    waited bool
+}
+
+func decompressCommand(name string, r io.Reader, input io.Closer) (io.ReadCloser, error) {
+    reader := &commandReader{name: name, input: input}
+    reader.cmd = exec.Command(name, "-dc")
+    reader.cmd.Stdin = r
+    reader.cmd.Stderr = &reader.stderr
+    // Close does not wait for a stalled input, stdin from ssh...
+    reader.cmd.WaitDelay = time.Second
+    stdout, err := reader.cmd.StdoutPipe()
+    if err != nil {
+        return nil, err
+    }
+    reader.stdout = stdout
+    if err = reader.cmd.Start(); err != nil {
+        return nil, fmt.Errorf("cannot run %s to decompress: %s", name, err)
+    }
+    return reader, nil
+}
+
+func (reader *commandReader) Read(p []byte) (int, error) {
+    n, err := reader.stdout.Read(p)
+    if err == io.EOF && !reader.waited {
+        reader.waited = true
+        if werr := reader.cmd.Wait(); werr != nil {
+            return n, fmt.Errorf("%s: %s %s", reader.name, werr,
+                strings.TrimSpace(reader.stderr.String()))
+        }
+    }
+    return n, err
+}
+
+func (reader *commandReader) Close() error {
+    if !reader.waited {
+        reader.waited = true
+        reader.cmd.Process.Kill()
+        reader.cmd.Wait()
+    }
+    return reader.input.Close()
+}
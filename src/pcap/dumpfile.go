@@ -0,0 +1,83 @@
+package pcap
+
+/* native writer for classic pcap savefiles, no libpcap needed */
+
+import (
+    "bufio"
+    "encoding/binary"
+    "io"
+)
+
+// Writer writes packets in the classic pcap format (little endian,
+// micro or nanoseconds), readable by tcpdump and Wireshark
+type Writer struct {
+    w        *bufio.Writer
+    linktype int
+    snaplen  uint32
+    nano     bool
+    hdr      [16]byte
+}
+
+// NewWriter writes the file header to w, the caller keeps ownership of w
+func NewWriter(w io.Writer, linktype int, snaplen uint32, precision int) (*Writer, error) {
+    writer := &Writer{
+        w:        bufio.NewWriterSize(w, 1<<16),
+        linktype: linktype,
+        snaplen:  snaplen,
+        nano:     precision == TSTAMP_PRECISION_NANO,
+    }
+    var hdr [24]byte
+    if writer.nano {
+        binary.LittleEndian.PutUint32(hdr[0:4], MAGIC_NANO)
+    } else {
+        binary.LittleEndian.PutUint32(hdr[0:4], MAGIC_MICRO)
+    }
+    binary.LittleEndian.PutUint16(hdr[4:6], 2)
+    binary.LittleEndian.PutUint16(hdr[6:8], 4)
+    binary.LittleEndian.PutUint32(hdr[16:20], snaplen)
+    if linktype == DLT_RAW || linktype == DLT_RAW_OPENBSD {
+        // the file wants the LINKTYPE_* value
+        binary.LittleEndian.PutUint32(hdr[20:24], LINKTYPE_RAW)
+    } else {
+        binary.LittleEndian.PutUint32(hdr[20:24], uint32(linktype))
+    }
+    if _, err := writer.w.Write(hdr[:]); err != nil {
+        return nil, err
+    }
+    return writer, nil
+}
+
+// WritePacket writes pkt.Data, truncated to the snaplen
+func (writer *Writer) WritePacket(pkt *Packet) error {
+    data := pkt.Data
+    if uint32(len(data)) > writer.snaplen {
+        data = data[:writer.snaplen]
+    }
+    length := pkt.Len
+    if length < uint32(len(data)) {
+        length = uint32(len(data))
+    }
+    hdr := writer.hdr[:]
+    binary.LittleEndian.PutUint32(hdr[0:4], uint32(pkt.Time.Unix()))
+    if writer.nano {
+        binary.LittleEndian.PutUint32(hdr[4:8], uint32(pkt.Time.Nanosecond()))
+    } else {
+        binary.LittleEndian.PutUint32(hdr[4:8], uint32(pkt.Time.Nanosecond()/1000))
+    }
+    binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(data)))
+    binary.LittleEndian.PutUint32(hdr[12:16], length)
+    if _, err := writer.w.Write(hdr); err != nil {
+        return err
+    }
+    _, err := writer.w.Write(data)
+    return err
+}
+
+// LinkType returns the link type given to NewWriter
+func (writer *Writer) LinkType() int {
+    return writer.linktype
+}
+
+func (writer *Writer) Flush() error {
+    return writer.w.Flush()
+}
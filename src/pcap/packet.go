@@ -0,0 +1,138 @@
+package pcap
+
+import (
+    "fmt"
+    "net"
+    "time"
+)
+
+// link types, as found in savefiles; libpcap gives the DLT_* value
+// which differs for raw IP
+const (
+    LINKTYPE_NULL       = 0
+    LINKTYPE_ETHERNET   = 1
+    LINKTYPE_RAW        = 101
+    LINKTYPE_LOOP       = 108
+    LINKTYPE_LINUX_SLL  = 113
+    LINKTYPE_IPV4       = 228
+    LINKTYPE_IPV6       = 229
+    LINKTYPE_LINUX_SLL2 = 276
+
+    DLT_RAW         = 12
+    DLT_RAW_OPENBSD = 14
+)
+
+// timestamp precisions, same values as PCAP_TSTAMP_PRECISION_*
+const (
+    TSTAMP_PRECISION_MICRO = 0
+    TSTAMP_PRECISION_NANO  = 1
+)
+
+// NextEx results, the pcap_next_ex ones, PCAP_ERROR_BREAK split in
+// end of file and Breakloop
+const (
+    NEXT_PACKET  = 1
+    NEXT_TIMEOUT = 0  // no packet during the read timeout
+    NEXT_ERROR   = -1 // see Geterror, the interface went down...
+    NEXT_EOF     = -2
+    NEXT_BREAK   = -3
+)
+
+// capture directions, same values as pcap_direction_t
+const (
+    DIRECTION_INOUT = 0
+    DIRECTION_IN    = 1
+    DIRECTION_OUT   = 2
+)
+
+// LiveOptions configures a live handle before its activation
+type LiveOptions struct {
+    Snaplen    int32
+    Promisc    bool
+    Timeout    int32 // read timeout in ms, 0 waits for a full buffer
+    BufferSize int32 // kernel buffer in bytes, 0 for the default
+    Immediate  bool  // deliver the packets as they arrive
+    Precision  int   // TSTAMP_PRECISION_*
+    Direction  int   // DIRECTION_*
+}
+
+var DefaultLiveOptions = LiveOptions{
+    Snaplen:   65535,
+    Promisc:   true,
+    Timeout:   1000,
+    Precision: TSTAMP_PRECISION_MICRO,
+    Direction: DIRECTION_INOUT,
+}
+
+// one compiled BPF instruction, laid out as struct bpf_insn
+type BPFInstruction struct {
+    Code uint16
+    Jt   uint8
+    Jf   uint8
+    K    uint32
+}
+
+// PACKET
+
+type Interface struct {
+    Name        string
+    Description string
+    Addresses   []IFAddress
+    // TODO: add more elements
+}
+
+type IFAddress struct {
+    IP      net.IP
+    Netmask net.IPMask
+    // TODO: add broadcast + PtP dst ?
+}
+
+// capture counters, as given by pcap_stats
+type Stats struct {
+    Received  uint64 // packets received
+    Dropped   uint64 // packets dropped by the kernel buffer
+    IfDropped uint64 // packets dropped by the interface or its driver
+}
+
+// VLAN_TAGS_MAX tags are kept per frame, enough for QinQ; the next
+// ones are skipped
+const VLAN_TAGS_MAX = 2
+
+// VlanTag is an 802.1Q or 802.1ad tag
+type VlanTag struct {
+    Tpid uint16 // 0x8100, 0x88A8 or 0x9100
+    Vid  uint16 // 12 bits
+    Pcp  uint8  // priority, 3 bits
+    Dei  bool   // drop eligible
+}
+
+type Packet struct {
+    Time     time.Time // packet send/receive time
+    Caplen   uint32    // bytes stored in the file (caplen <= len)
+    Len      uint32    // bytes sent/received
+    Data     []byte    // packet data
+    LinkType int       // link type of the capture, see LINKTYPE_*
+    Iface    string    // capture interface, empty for files
+
+    Type    int // protocol type, see LINKTYPE_*
+    DestMac uint64
+    SrcMac  uint64
+
+    Payload []byte // remaining non-header bytes
+    Vlan    int    // outer VLAN ID, -1 when untagged
+    Tags    [VLAN_TAGS_MAX]VlanTag
+    NTags   int // tags kept in Tags, outer first
+
+    buf  []byte // pooled buffer behind Data
+    refs int32
+}
+
+// PACKET
+func (pkt *Packet) Show() string {
+    return fmt.Sprintf("src[%16x] dst[%16x] Type[%4x]",
+        pkt.SrcMac, pkt.DestMac, pkt.Type)
+}
+
+func (pkt *Packet) GetTime() time.Time {
+    return pkt.Time
+}
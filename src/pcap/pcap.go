@@ -18,7 +18,7 @@ import "C"
 import (
     "errors"
     "fmt"
-    "net"
+    "sync/atomic"
     "syscall"
     "time"
     "unsafe"
@@ -31,28 +31,31 @@ const (
 // PCAP reader
 
 type Pcap struct {
-    cptr   *C.pcap_t
-    Paused bool
+    cptr      *C.pcap_t
+    linktype  int
+    precision int
+    broken    int32 // atomic, set by Breakloop
+    err       error // read error which ended Next
 }
 
+// Next returns the next packet, going on after the read timeouts; nil
+// at the end of the file, after Breakloop or on a read error, see Err
 func (p *Pcap) Next() (pkt *Packet) {
-    paused := false
-    if p.Paused {
-        //fmt.Print("(reader paused)\n")
-        paused = true
-    }
-    for p.Paused {
-        time.Sleep(1000000)
-    }
-
-    if paused {
-        //fmt.Print("(reader unpaused)\n")
-        paused = false
+    for {
+        pkt, result := p.NextEx()
+        switch result {
+        case NEXT_PACKET:
+            return pkt
+        case NEXT_TIMEOUT:
+            continue
+        case NEXT_ERROR:
+            p.err = p.Geterror()
+        }
+        return nil
     }
-    rv, _ := p.NextEx()
-    return rv
 }
 
+// NextEx reads one packet, result is one of NEXT_*
 func (p *Pcap) NextEx() (pkt *Packet, result int32) {
     var pkthdr_ptr *C.struct_pcap_pkthdr
     var pkthdr C.struct_pcap_pkthdr
@@ -60,35 +63,59 @@ func (p *Pcap) NextEx() (pkt *Packet, result int32) {
     var buf_ptr *C.u_char
     var buf unsafe.Pointer
     result = int32(C.hack_pcap_next_ex(p.cptr, &pkthdr_ptr, &buf_ptr))
+    if result == NEXT_EOF && atomic.LoadInt32(&p.broken) != 0 {
+        result = NEXT_BREAK
+    }
+    if result != NEXT_PACKET {
+        return nil, result
+    }
 
     buf = unsafe.Pointer(buf_ptr)
     pkthdr = *pkthdr_ptr
-
     if nil == buf {
-        return
+        return nil, result
     }
-    pkt = new(Packet)
-    pkt.Time = time.Unix(int64(pkthdr.ts.tv_sec), int64(pkthdr.ts.tv_usec))
-    pkt.Caplen = uint32(pkthdr.caplen)
-    pkt.Len = uint32(pkthdr.len)
-    pkt.Data = make([]byte, pkthdr.caplen)
-
-    for i := uint32(0); i < pkt.Caplen; i++ {
-        pkt.Data[i] = *(*byte)(unsafe.Pointer(uintptr(buf) + uintptr(i)))
+    pkt = NewPacket(uint32(pkthdr.caplen))
+    // tv_usec holds nanoseconds with the nano precision
+    frac := int64(pkthdr.ts.tv_usec)
+    if p.precision == TSTAMP_PRECISION_MICRO {
+        frac *= 1000
     }
+    pkt.Time = time.Unix(int64(pkthdr.ts.tv_sec), frac)
+    pkt.Len = uint32(pkthdr.len)
+    pkt.LinkType = p.linktype
+    copy(pkt.Data, cbytes(buf, int(pkt.Caplen)))
     return
 }
 
+// cbytes sees size bytes of C memory as a slice, without copying
+func cbytes(ptr unsafe.Pointer, size int) []byte {
+    return (*[1 << 30]byte)(ptr)[:size:size]
+}
+
 func (p *Pcap) Close() {
     C.pcap_close(p.cptr)
 }
 
+// Breakloop makes Next return nil, from another goroutine; the reader
+// closes the handle
+func (p *Pcap) Breakloop() {
+    atomic.StoreInt32(&p.broken, 1)
+    C.pcap_breakloop(p.cptr)
+}
+
+// Err is the read error which ended Next, nil at the end of the file
+// and after Breakloop
+func (p *Pcap) Err() error {
+    return p.err
+}
+
 func (p *Pcap) Geterror() error {
     return errors.New(C.GoString(C.pcap_geterr(p.cptr)))
 }
 
 func (p *Pcap) Setfilter(expr string) (err error) {
-    var bpf _Ctype_struct_bpf_program
+    var bpf C.struct_bpf_program
     cexpr := C.CString(expr)
     defer C.free(unsafe.Pointer(cexpr))
 
@@ -104,6 +131,79 @@ func (p *Pcap) Setfilter(expr string) (err error) {
     return nil
 }
 
+func (p *Pcap) Stats() (stats *Stats, err error) {
+    var cstats C.struct_pcap_stat
+    if -1 == C.pcap_stats(p.cptr, &cstats) {
+        return nil, p.Geterror()
+    }
+    stats = new(Stats)
+    stats.Received = uint64(cstats.ps_recv)
+    stats.Dropped = uint64(cstats.ps_drop)
+    stats.IfDropped = uint64(cstats.ps_ifdrop)
+    return
+}
+
+func (p *Pcap) LinkType() int {
+    return p.linktype
+}
+
+// BPF is a compiled filter, matched against packets in user space
+type BPF struct {
+    program  C.struct_bpf_program
+    linktype int
+}
+
+// Compile compiles a filter expression for the given link type
+func Compile(linktype int, snaplen int32, expr string) (*BPF, error) {
+    dead := C.pcap_open_dead(C.int(linktype), C.int(snaplen))
+    if nil == dead {
+        return nil, errors.New("pcap_open_dead failed")
+    }
+    defer C.pcap_close(dead)
+    cexpr := C.CString(expr)
+    defer C.free(unsafe.Pointer(cexpr))
+
+    bpf := &BPF{linktype: linktype}
+    if -1 == C.pcap_compile(dead, &bpf.program, cexpr, 1, C.PCAP_NETMASK_UNKNOWN) {
+        return nil, errors.New(C.GoString(C.pcap_geterr(dead)))
+    }
+    return bpf, nil
+}
+
+func (bpf *BPF) Match(pkt *Packet) bool {
+    if len(pkt.Data) == 0 {
+        return false
+    }
+    var hdr C.struct_pcap_pkthdr
+    hdr.caplen = C.bpf_u_int32(len(pkt.Data))
+    hdr.len = C.bpf_u_int32(pkt.Len)
+    data := (*C.u_char)(unsafe.Pointer(&pkt.Data[0]))
+    return 0 != C.pcap_offline_filter(&bpf.program, &hdr, data)
+}
+
+// Instructions returns a copy of the compiled program, to attach it
+// to a socket
+func (bpf *BPF) Instructions() []BPFInstruction {
+    size := int(bpf.program.bf_len)
+    if size == 0 {
+        return nil
+    }
+    cinsns := (*[1 << 20]C.struct_bpf_insn)(unsafe.Pointer(bpf.program.bf_insns))[:size:size]
+    insns := make([]BPFInstruction, size)
+    for i, cinsn := range cinsns {
+        insns[i] = BPFInstruction{uint16(cinsn.code), uint8(cinsn.jt), uint8(cinsn.jf), uint32(cinsn.k)}
+    }
+    return insns
+}
+
+func (bpf *BPF) LinkType() int {
+    return bpf.linktype
+}
+
+func (bpf *BPF) Free() {
+    C.pcap_freecode(&bpf.program)
+}
+
 func (p *Pcap) Datalink() int {
     return int(C.pcap_datalink(p.cptr))
 }
@@ -112,15 +212,13 @@ func (p *Pcap) Setdatalink(dlt int) error {
     if -1 == C.pcap_set_datalink(p.cptr, C.int(dlt)) {
         return p.Geterror()
     }
+    p.linktype = dlt
     return nil
 }
 
 func (p *Pcap) Inject(data []byte) (err error) {
     buf := (*C.char)(C.malloc((C.size_t)(len(data))))
-
-    for i := 0; i < len(data); i++ {
-        *(*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(buf)) + uintptr(i))) = data[i]
-    }
+    copy(cbytes(unsafe.Pointer(buf), len(data)), data)
 
     if -1 == C.pcap_inject(p.cptr, unsafe.Pointer(buf), (C.size_t)(len(data))) {
         err = p.Geterror()
@@ -129,84 +227,179 @@ func (p *Pcap) Inject(data []byte) (err error) {
     return
 }
 
-// PACKET
+// Openlive opens a device and returns a *Pcap handler
+func Openlive(device string, snaplen int32, promisc bool, timeout_ms int32) (handle *Pcap, err error) {
+    return OpenliveWithPrecision(device, snaplen, promisc, timeout_ms, TSTAMP_PRECISION_MICRO)
+}
+
+// OpenliveWithPrecision opens a device with the create/activate calls,
+// the only way to ask for nanosecond timestamps
+func OpenliveWithPrecision(device string, snaplen int32, promisc bool, timeout_ms int32, precision int) (handle *Pcap, err error) {
+    opts := LiveOptions{
+        Snaplen:   snaplen,
+        Promisc:   promisc,
+        Timeout:   timeout_ms,
+        Precision: precision,
+        Direction: DIRECTION_INOUT,
+    }
+    handle, _, err = OpenliveOptions(device, opts)
+    return
+}
+
+// OpenliveOptions creates, configures and activates a handle. The
+// handle comes with a warning when the activation gave one, promiscuous
+// mode not supported...
+func OpenliveOptions(device string, opts LiveOptions) (handle *Pcap, warning error, err error) {
+    h, err := Create(device)
+    if err != nil {
+        return nil, nil, err
+    }
+    if err = h.configure(opts); err == nil {
+        warning, err = h.Activate()
+    }
+    if err == nil && opts.Direction != DIRECTION_INOUT {
+        err = h.SetDirection(opts.Direction)
+    }
+    if err != nil {
+        h.Close()
+        return nil, nil, err
+    }
+    return h, warning, nil
+}
 
-type Interface struct {
-    Name        string
-    Description string
-    Addresses   []IFAddress
-    // TODO: add more elements
+func (p *Pcap) configure(opts LiveOptions) error {
+    if err := p.SetSnaplen(opts.Snaplen); err != nil {
+        return err
+    }
+    if err := p.SetPromisc(opts.Promisc); err != nil {
+        return err
+    }
+    if err := p.SetTimeout(opts.Timeout); err != nil {
+        return err
+    }
+    if opts.BufferSize > 0 {
+        if err := p.SetBufferSize(opts.BufferSize); err != nil {
+            return err
+        }
+    }
+    if err := p.SetImmediateMode(opts.Immediate); err != nil {
+        return err
+    }
+    return p.SetTstampPrecision(opts.Precision)
 }
 
-type IFAddress struct {
-    IP      net.IP
-    Netmask net.IPMask
-    // TODO: add broadcast + PtP dst ?
+// Create gives a handle to configure, then to activate
+func Create(device string) (*Pcap, error) {
+    buf := (*C.char)(C.calloc(ERRBUF_SIZE, 1))
+    defer C.free(unsafe.Pointer(buf))
+    dev := C.CString(device)
+    defer C.free(unsafe.Pointer(dev))
+
+    h := new(Pcap)
+    h.cptr = C.pcap_create(dev, buf)
+    if nil == h.cptr {
+        return nil, errors.New(C.GoString(buf))
+    }
+    return h, nil
 }
 
-type Packet struct {
-    Time   time.Time // packet send/receive time
-    Caplen uint32    // bytes stored in the file (caplen <= len)
-    Len    uint32    // bytes sent/received
-    Data   []byte    // packet data
+// setting errors, the handle is created but not activated yet: the
+// setters fail once pcap_activate has run
+func (p *Pcap) setError(what string, status C.int) error {
+    if status == 0 {
+        return nil
+    }
+    return fmt.Errorf("%s: %s", what, p.statusError(status))
+}
 
-    Type    int // protocol type, see LINKTYPE_*
-    DestMac uint64
-    SrcMac  uint64
+func (p *Pcap) SetSnaplen(snaplen int32) error {
+    return p.setError("snaplen", C.pcap_set_snaplen(p.cptr, C.int(snaplen)))
+}
 
-    Payload []byte // remaining non-header bytes
-    Vlan    int    // Vlan ID
+func (p *Pcap) SetPromisc(promisc bool) error {
+    return p.setError("promiscuous mode", C.pcap_set_promisc(p.cptr, cbool(promisc)))
 }
 
-// PACKET
-func (pkt *Packet) Show() string {
-    return fmt.Sprintf("src[%16x] dst[%16x] Type[%4x]",
-        pkt.SrcMac, pkt.DestMac, pkt.Type)
+func (p *Pcap) SetTimeout(timeout_ms int32) error {
+    return p.setError("timeout", C.pcap_set_timeout(p.cptr, C.int(timeout_ms)))
 }
 
-func (pkt *Packet) GetTime() time.Time {
-    return pkt.Time
+func (p *Pcap) SetBufferSize(size int32) error {
+    return p.setError("buffer size", C.pcap_set_buffer_size(p.cptr, C.int(size)))
 }
 
-// Openlive opens a device and returns a *Pcap handler
-func Openlive(device string, snaplen int32, promisc bool, timeout_ms int32) (handle *Pcap, err error) {
-    var buf *C.char
-    buf = (*C.char)(C.calloc(ERRBUF_SIZE, 1))
-    h := new(Pcap)
-    h.Paused = false
-    var pro int32
-    if promisc {
-        pro = 1
+func (p *Pcap) SetImmediateMode(immediate bool) error {
+    return p.setError("immediate mode", C.pcap_set_immediate_mode(p.cptr, cbool(immediate)))
+}
+
+func (p *Pcap) SetTstampPrecision(precision int) error {
+    if err := p.setError("timestamp precision",
+        C.pcap_set_tstamp_precision(p.cptr, C.int(precision))); err != nil {
+        return err
     }
+    p.precision = precision
+    return nil
+}
 
-    dev := C.CString(device)
-    defer C.free(unsafe.Pointer(dev))
+// Activate starts the capture; the warning is not fatal
+func (p *Pcap) Activate() (warning error, err error) {
+    status := C.pcap_activate(p.cptr)
+    if status < 0 {
+        return nil, p.statusError(status)
+    }
+    if status > 0 {
+        warning = p.statusError(status)
+    }
+    p.linktype = p.Datalink()
+    return warning, nil
+}
 
-    h.cptr = C.pcap_open_live(dev, C.int(snaplen), C.int(pro), C.int(timeout_ms), buf)
-    if nil == h.cptr {
-        handle = nil
-        err = errors.New(C.GoString(buf))
-    } else {
-        handle = h
+// SetDirection only keeps the packets received (DIRECTION_IN), or sent
+// (DIRECTION_OUT); on an activated handle
+func (p *Pcap) SetDirection(direction int) error {
+    if C.pcap_setdirection(p.cptr, C.pcap_direction_t(direction)) != 0 {
+        return fmt.Errorf("direction: %s", p.Geterror())
     }
-    C.free(unsafe.Pointer(buf))
-    return
+    return nil
+}
+
+func cbool(value bool) C.int {
+    if value {
+        return 1
+    }
+    return 0
+}
+
+// statusError describes a pcap_activate status, error or warning
+func (p *Pcap) statusError(status C.int) error {
+    msg := C.GoString(C.pcap_statustostr(status))
+    if detail := C.GoString(C.pcap_geterr(p.cptr)); detail != "" {
+        msg += ": " + detail
+    }
+    return errors.New(msg)
 }
 
 func Openoffline(file string) (handle *Pcap, err error) {
+    return OpenofflineWithPrecision(file, TSTAMP_PRECISION_MICRO)
+}
+
+// OpenofflineWithPrecision opens a file, libpcap scales the timestamps
+// to the precision asked for
+func OpenofflineWithPrecision(file string, precision int) (handle *Pcap, err error) {
     var buf *C.char
     buf = (*C.char)(C.calloc(ERRBUF_SIZE, 1))
     h := new(Pcap)
-    h.Paused = false
+    h.precision = precision
 
     cf := C.CString(file)
     defer C.free(unsafe.Pointer(cf))
 
-    h.cptr = C.pcap_open_offline(cf, buf)
+    h.cptr = C.pcap_open_offline_with_tstamp_precision(cf, C.u_int(precision), buf)
     if nil == h.cptr {
         handle = nil
         err = errors.New(C.GoString(buf))
     } else {
+        h.linktype = h.Datalink()
         handle = h
     }
     C.free(unsafe.Pointer(buf))
@@ -260,10 +453,10 @@ func Findalldevs() (ifs []Interface, err error) {
     return
 }
 
-func findalladdresses(addresses *_Ctype_struct_pcap_addr) (retval []IFAddress) {
+func findalladdresses(addresses *C.struct_pcap_addr) (retval []IFAddress) {
     // TODO - make it support more than IPv4 and IPv6?
     retval = make([]IFAddress, 0, 1)
-    for curaddr := addresses; curaddr != nil; curaddr = (*_Ctype_struct_pcap_addr)(curaddr.next) {
+    for curaddr := addresses; curaddr != nil; curaddr = (*C.struct_pcap_addr)(curaddr.next) {
         var a IFAddress
         var err error
         if a.IP, err = sockaddr_to_IP((*syscall.RawSockaddr)(unsafe.Pointer(curaddr.addr))); err != nil {
@@ -282,16 +475,12 @@ func sockaddr_to_IP(rsa *syscall.RawSockaddr) (IP []byte, err error) {
     case syscall.AF_INET:
         pp := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
         IP = make([]byte, 4)
-        for i := 0; i < len(IP); i++ {
-            IP[i] = pp.Addr[i]
-        }
+        copy(IP, pp.Addr[:])
         return
     case syscall.AF_INET6:
         pp := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
         IP = make([]byte, 16)
-        for i := 0; i < len(IP); i++ {
-            IP[i] = pp.Addr[i]
-        }
+        copy(IP, pp.Addr[:])
         return
     }
     err = errors.New("Unsupported address type")
@@ -0,0 +1,121 @@
+//go:build !cgo
+// +build !cgo
+
+package pcap
+
+/* fallback when built without cgo: offline files use the native reader,
+   everything that needs libpcap returns an error */
+
+import (
+    "errors"
+)
+
+var errNoLibpcap = errors.New("built without cgo, libpcap is not available")
+
+// PCAP reader
+
+type Pcap struct {
+    file *FileReader
+}
+
+func (p *Pcap) Next() (pkt *Packet) {
+    return p.file.Next()
+}
+
+func (p *Pcap) Close() {
+    p.file.Close()
+}
+
+func (p *Pcap) Breakloop() {
+    p.file.Breakloop()
+}
+
+func (p *Pcap) Err() error {
+    return p.file.Err()
+}
+
+func (p *Pcap) Geterror() error {
+    return p.file.Geterror()
+}
+
+func (p *Pcap) Setfilter(expr string) (err error) {
+    return errNoLibpcap
+}
+
+func (p *Pcap) Stats() (stats *Stats, err error) {
+    return p.file.Stats()
+}
+
+func (p *Pcap) LinkType() int {
+    return p.file.LinkType()
+}
+
+type BPF struct{}
+
+func Compile(linktype int, snaplen int32, expr string) (*BPF, error) {
+    return nil, errNoLibpcap
+}
+
+func (bpf *BPF) Match(pkt *Packet) bool {
+    return false
+}
+
+func (bpf *BPF) Instructions() []BPFInstruction {
+    return nil
+}
+
+func (bpf *BPF) LinkType() int {
+    return -1
+}
+
+func (bpf *BPF) Free() {
+}
+
+func (p *Pcap) Datalink() int {
+    return p.file.Datalink()
+}
+
+func (p *Pcap) Inject(data []byte) (err error) {
+    return errNoLibpcap
+}
+
+func Openlive(device string, snaplen int32, promisc bool, timeout_ms int32) (handle *Pcap, err error) {
+    return nil, errNoLibpcap
+}
+
+func OpenliveOptions(device string, opts LiveOptions) (handle *Pcap, warning error, err error) {
+    return nil, nil, errNoLibpcap
+}
+
+func OpenliveWithPrecision(device string, snaplen int32, promisc bool, timeout_ms int32, precision int) (handle *Pcap, err error) {
+    return nil, errNoLibpcap
+}
+
+// the native reader always gives the precision of the file
+func OpenofflineWithPrecision(file string, precision int) (handle *Pcap, err error) {
+    return Openoffline(file)
+}
+
+func Openoffline(file string) (handle *Pcap, err error) {
+    reader, err := Openfile(file)
+    if err != nil {
+        return nil, err
+    }
+    return &Pcap{file: reader}, nil
+}
+
+func Version() string {
+    return "native reader (no libpcap)"
+}
+
+func DatalinkValueToName(dlt int) string {
+    return ""
+}
+
+func DatalinkValueToDescription(dlt int) string {
+    return ""
+}
+
+func Findalldevs() (ifs []Interface, err error) {
+    return nil, errNoLibpcap
+}
@@ -0,0 +1,51 @@
+package pcap
+
+import (
+    "sync"
+    "sync/atomic"
+)
+
+const (
+    // smallest buffer kept in the pool, enough for a full Ethernet frame
+    POOL_BUFFER_MIN = 2048
+)
+
+var packetPool = sync.Pool{
+    New: func() interface{} {
+        return new(Packet)
+    },
+}
+
+// NewPacket takes a packet from the pool, with caplen bytes of Data.
+// The caller holds the only reference.
+func NewPacket(caplen uint32) *Packet {
+    pkt := packetPool.Get().(*Packet)
+    if uint32(cap(pkt.buf)) < caplen {
+        size := caplen
+        if size < POOL_BUFFER_MIN {
+            size = POOL_BUFFER_MIN
+        }
+        pkt.buf = make([]byte, size)
+    }
+    pkt.Caplen = caplen
+    pkt.Data = pkt.buf[:caplen]
+    pkt.refs = 1
+    return pkt
+}
+
+// Retain takes one more reference, for each layer handler the packet
+// is handed to
+func (pkt *Packet) Retain() {
+    atomic.AddInt32(&pkt.refs, 1)
+}
+
+// Release drops a reference; the last one puts the packet and its
+// buffer back into the pool
+func (pkt *Packet) Release() {
+    if atomic.AddInt32(&pkt.refs, -1) != 0 {
+        return
+    }
+    buf := pkt.buf
+    *pkt = Packet{buf: buf}
+    packetPool.Put(pkt)
+}
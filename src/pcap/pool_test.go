@@ -0,0 +1,77 @@
+package pcap
+
+import (
+    "encoding/binary"
+    "testing"
+)
+
+// BENCHMARKS
+// the allocations per packet read, with the packets released to the
+// pool or kept, as before the pool:
+//   go test -bench . -benchmem pcap
+
+const BENCH_FRAME_LEN = 1514
+
+// benchStream is a classic pcap stream repeating one frame forever
+type benchStream struct {
+    header []byte
+    record []byte
+    offset int
+}
+
+func newBenchStream(size int) *benchStream {
+    header := make([]byte, 24)
+    binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+    binary.LittleEndian.PutUint16(header[4:6], 2)
+    binary.LittleEndian.PutUint16(header[6:8], 4)
+    binary.LittleEndian.PutUint32(header[16:20], 65535)
+    binary.LittleEndian.PutUint32(header[20:24], LINKTYPE_ETHERNET)
+    record := make([]byte, 16+size)
+    binary.LittleEndian.PutUint32(record[8:12], uint32(size))
+    binary.LittleEndian.PutUint32(record[12:16], uint32(size))
+    return &benchStream{header: header, record: record}
+}
+
+func (stream *benchStream) Read(p []byte) (int, error) {
+    n := 0
+    for n < len(p) {
+        if len(stream.header) > 0 {
+            copied := copy(p[n:], stream.header)
+            stream.header = stream.header[copied:]
+            n += copied
+            continue
+        }
+        copied := copy(p[n:], stream.record[stream.offset:])
+        stream.offset = (stream.offset + copied) % len(stream.record)
+        n += copied
+    }
+    return n, nil
+}
+
+func benchmarkNext(b *testing.B, release bool) {
+    reader, err := Openreader(newBenchStream(BENCH_FRAME_LEN))
+    if err != nil {
+        b.Fatal(err)
+    }
+    b.ReportAllocs()
+    b.SetBytes(BENCH_FRAME_LEN)
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        pkt, err := reader.ReadPacket()
+        if err != nil {
+            b.Fatal(err)
+        }
+        if release {
+            pkt.Release()
+        }
+    }
+}
+
+func BenchmarkNextPooled(b *testing.B) {
+    benchmarkNext(b, true)
+}
+
+// the packets are left to the GC, each one is allocated again
+func BenchmarkNextUnpooled(b *testing.B) {
+    benchmarkNext(b, false)
+}
@@ -0,0 +1,469 @@
+package pcap
+
+/* native reader for pcap and pcapng savefiles, no libpcap needed */
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "math/bits"
+    "os"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    // classic pcap magics, as read in big endian
+    MAGIC_MICRO         = 0xa1b2c3d4
+    MAGIC_MICRO_SWAPPED = 0xd4c3b2a1
+    MAGIC_NANO          = 0xa1b23c4d
+    MAGIC_NANO_SWAPPED  = 0x4d3cb2a1
+
+    // pcapng block types
+    NG_BLOCK_SHB                = 0x0a0d0d0a
+    NG_BLOCK_IDB                = 0x00000001
+    NG_BLOCK_SPB                = 0x00000003
+    NG_BLOCK_EPB                = 0x00000006
+    NG_BYTE_ORDER_MAGIC         = 0x1a2b3c4d
+    NG_BYTE_ORDER_MAGIC_SWAPPED = 0x4d3c2b1a
+
+    // pcapng interface options
+    NG_OPT_ENDOFOPT = 0
+    NG_OPT_TSRESOL  = 9
+    NG_OPT_TSOFFSET = 14
+
+    // same limit as libpcap, protects against corrupted files
+    MAX_CAPLEN = 262144
+)
+
+// one interface described by a pcapng IDB
+type ngInterface struct {
+    linktype int
+    snaplen  uint32
+    tsunits  uint64 // timestamp units per second
+    tsoffset int64  // seconds to add to every timestamp
+}
+
+// FileReader reads a pcap or pcapng stream without libpcap.
+// Next() follows the same contract as Pcap.Next(): nil at the end.
+type FileReader struct {
+    r      *bufio.Reader
+    closer io.Closer
+    err    error
+    count  uint64
+    broken int32 // atomic, set by Breakloop
+
+    order binary.ByteOrder
+    ng    bool
+
+    // classic pcap
+    linktype int
+    snaplen  uint32
+    nano     bool
+
+    // pcapng
+    ifaces   []ngInterface
+    lasttime time.Time
+    pending  *Packet // read at open to learn the link type
+
+    hdr [28]byte
+}
+
+// Openfile opens a savefile on disk, "-" for stdin, compressed or not
+func Openfile(file string) (*FileReader, error) {
+    var fd *os.File
+    if file == "-" {
+        fd = os.Stdin
+    } else {
+        var err error
+        if fd, err = os.Open(file); err != nil {
+            return nil, err
+        }
+    }
+    stream, err := Decompress(fd)
+    if err != nil {
+        fd.Close()
+        return nil, err
+    }
+    reader, err := Openreader(stream)
+    if err != nil {
+        stream.Close()
+        return nil, err
+    }
+    return reader, nil
+}
+
+// Openreader reads a savefile from any stream; the stream is closed
+// with the reader when it is an io.Closer
+func Openreader(r io.Reader) (*FileReader, error) {
+    reader := new(FileReader)
+    reader.r = bufio.NewReaderSize(r, 1<<16)
+    if closer, ok := r.(io.Closer); ok {
+        reader.closer = closer
+    }
+
+    magic, err := reader.r.Peek(4)
+    if err != nil {
+        return nil, fmt.Errorf("cannot read file header: %s", err)
+    }
+    switch binary.BigEndian.Uint32(magic) {
+    case MAGIC_MICRO, MAGIC_NANO:
+        reader.order = binary.BigEndian
+        err = reader.readFileHeader()
+    case MAGIC_MICRO_SWAPPED, MAGIC_NANO_SWAPPED:
+        reader.order = binary.LittleEndian
+        err = reader.readFileHeader()
+    case NG_BLOCK_SHB:
+        reader.ng = true
+        if _, err = io.ReadFull(reader.r, reader.hdr[:8]); err == nil {
+            err = reader.readSectionHeader()
+        }
+        if err == nil {
+            reader.pending, err = reader.readBlock()
+            if err == io.EOF {
+                err = nil
+            }
+        }
+    default:
+        err = errors.New("unknown file format")
+    }
+    if err != nil {
+        return nil, err
+    }
+    return reader, nil
+}
+
+func (reader *FileReader) readFileHeader() error {
+    hdr := reader.hdr[:24]
+    if _, err := io.ReadFull(reader.r, hdr); err != nil {
+        return fmt.Errorf("truncated file header: %s", err)
+    }
+    reader.nano = reader.order.Uint32(hdr[0:4]) == MAGIC_NANO
+    reader.snaplen = reader.order.Uint32(hdr[16:20])
+    // upper bits of the network field carry FCS information
+    reader.linktype = int(reader.order.Uint32(hdr[20:24]) & 0xFFFF)
+    return nil
+}
+
+// readSectionHeader reads the rest of a SHB whose type and length are
+// already in reader.hdr; the SHB gives the byte order of the section
+func (reader *FileReader) readSectionHeader() error {
+    hdr := reader.hdr[:12]
+    if _, err := io.ReadFull(reader.r, hdr[8:12]); err != nil {
+        return errors.New("truncated section header")
+    }
+    switch binary.BigEndian.Uint32(hdr[8:12]) {
+    case NG_BYTE_ORDER_MAGIC:
+        reader.order = binary.BigEndian
+    case NG_BYTE_ORDER_MAGIC_SWAPPED:
+        reader.order = binary.LittleEndian
+    default:
+        return errors.New("bad pcapng byte order magic")
+    }
+    length := reader.order.Uint32(hdr[4:8])
+    if length < 28 || length%4 != 0 {
+        return fmt.Errorf("bad pcapng section header length %d", length)
+    }
+    // interfaces are numbered per section
+    reader.ifaces = reader.ifaces[:0]
+    _, err := reader.r.Discard(int(length) - 12)
+    return err
+}
+
+func (reader *FileReader) Next() (pkt *Packet) {
+    if atomic.LoadInt32(&reader.broken) != 0 {
+        return nil
+    }
+    pkt, err := reader.ReadPacket()
+    if err != nil && err != io.EOF {
+        reader.err = err
+    }
+    return pkt
+}
+
+// ReadPacket returns the next packet, or io.EOF at the end of the stream
+func (reader *FileReader) ReadPacket() (pkt *Packet, err error) {
+    if reader.pending != nil {
+        pkt, reader.pending = reader.pending, nil
+    } else if reader.ng {
+        pkt, err = reader.readBlock()
+    } else {
+        pkt, err = reader.readRecord()
+    }
+    if pkt != nil {
+        reader.count++
+    }
+    return
+}
+
+func (reader *FileReader) readRecord() (*Packet, error) {
+    hdr := reader.hdr[:16]
+    if _, err := io.ReadFull(reader.r, hdr); err != nil {
+        if err == io.ErrUnexpectedEOF {
+            return nil, errors.New("truncated record header")
+        }
+        return nil, err
+    }
+    sec := int64(reader.order.Uint32(hdr[0:4]))
+    frac := int64(reader.order.Uint32(hdr[4:8]))
+    if !reader.nano {
+        frac *= 1000
+    }
+    pkt, err := reader.readData(reader.order.Uint32(hdr[8:12]))
+    if err != nil {
+        return nil, err
+    }
+    pkt.Time = time.Unix(sec, frac)
+    pkt.Len = reader.order.Uint32(hdr[12:16])
+    pkt.LinkType = reader.linktype
+    return pkt, nil
+}
+
+func (reader *FileReader) readData(caplen uint32) (*Packet, error) {
+    if caplen > MAX_CAPLEN {
+        return nil, fmt.Errorf("invalid packet length %d", caplen)
+    }
+    pkt := NewPacket(caplen)
+    if _, err := io.ReadFull(reader.r, pkt.Data); err != nil {
+        pkt.Release()
+        return nil, errors.New("truncated packet data")
+    }
+    return pkt, nil
+}
+
+// readBlock skips pcapng blocks until one holds a packet
+func (reader *FileReader) readBlock() (*Packet, error) {
+    for {
+        hdr := reader.hdr[:8]
+        if _, err := io.ReadFull(reader.r, hdr); err != nil {
+            if err == io.ErrUnexpectedEOF {
+                return nil, errors.New("truncated block header")
+            }
+            return nil, err
+        }
+        blocktype := reader.order.Uint32(hdr[0:4])
+        if blocktype == NG_BLOCK_SHB {
+            // the byte order may change with the new section
+            if err := reader.readSectionHeader(); err != nil {
+                return nil, err
+            }
+            continue
+        }
+        length := int(reader.order.Uint32(hdr[4:8]))
+        if length < 12 || length%4 != 0 {
+            return nil, fmt.Errorf("bad pcapng block length %d", length)
+        }
+        // body, without the header and the trailing length
+        body := length - 12
+
+        var pkt *Packet
+        var err error
+        switch blocktype {
+        case NG_BLOCK_IDB:
+            err = reader.readInterface(body)
+        case NG_BLOCK_EPB:
+            pkt, err = reader.readEnhancedPacket(body)
+        case NG_BLOCK_SPB:
+            pkt, err = reader.readSimplePacket(body)
+        default:
+            _, err = reader.r.Discard(body)
+        }
+        if err != nil {
+            return nil, err
+        }
+        if _, err = reader.r.Discard(4); err != nil {
+            return nil, errors.New("truncated block trailer")
+        }
+        if pkt != nil {
+            return pkt, nil
+        }
+    }
+}
+
+func (reader *FileReader) readInterface(body int) error {
+    if body < 8 {
+        return errors.New("truncated interface block")
+    }
+    hdr := reader.hdr[:8]
+    if _, err := io.ReadFull(reader.r, hdr); err != nil {
+        return errors.New("truncated interface block")
+    }
+    iface := ngInterface{
+        linktype: int(reader.order.Uint16(hdr[0:2])),
+        snaplen:  reader.order.Uint32(hdr[4:8]),
+        tsunits:  1000000,
+    }
+
+    // the length comes from the file, no real block is that big
+    if body-8 > MAX_CAPLEN {
+        return fmt.Errorf("invalid interface options length %d", body-8)
+    }
+    options := make([]byte, body-8)
+    if _, err := io.ReadFull(reader.r, options); err != nil {
+        return errors.New("truncated interface options")
+    }
+    for len(options) >= 4 {
+        code := reader.order.Uint16(options[0:2])
+        size := int(reader.order.Uint16(options[2:4]))
+        if code == NG_OPT_ENDOFOPT || 4+size > len(options) {
+            break
+        }
+        value := options[4 : 4+size]
+        switch {
+        case code == NG_OPT_TSRESOL && size == 1:
+            iface.tsunits = tsresolUnits(value[0])
+        case code == NG_OPT_TSOFFSET && size == 8:
+            iface.tsoffset = int64(reader.order.Uint64(value))
+        }
+        // values are padded to 32 bits
+        options = options[4+(size+3)&^3:]
+    }
+    if iface.tsunits == 0 {
+        return errors.New("unsupported interface timestamp resolution")
+    }
+    reader.ifaces = append(reader.ifaces, iface)
+    return nil
+}
+
+// tsresolUnits decodes if_tsresol: a power of 10, or of 2 when the MSB is set
+func tsresolUnits(resol byte) uint64 {
+    exp := uint(resol & 0x7F)
+    if resol&0x80 != 0 {
+        if exp > 63 {
+            return 0
+        }
+        return uint64(1) << exp
+    }
+    units := uint64(1)
+    for i := uint(0); i < exp; i++ {
+        hi, lo := bits.Mul64(units, 10)
+        if hi != 0 {
+            return 0
+        }
+        units = lo
+    }
+    return units
+}
+
+func (reader *FileReader) readEnhancedPacket(body int) (*Packet, error) {
+    if body < 20 {
+        return nil, errors.New("truncated enhanced packet block")
+    }
+    hdr := reader.hdr[:20]
+    if _, err := io.ReadFull(reader.r, hdr); err != nil {
+        return nil, errors.New("truncated enhanced packet block")
+    }
+    ifid := reader.order.Uint32(hdr[0:4])
+    if int(ifid) >= len(reader.ifaces) {
+        return nil, fmt.Errorf("packet on undeclared interface %d", ifid)
+    }
+    iface := &reader.ifaces[ifid]
+    ts := uint64(reader.order.Uint32(hdr[4:8]))<<32 | uint64(reader.order.Uint32(hdr[8:12]))
+    caplen := reader.order.Uint32(hdr[12:16])
+    padded := int(caplen+3) &^ 3
+    if 20+padded > body {
+        return nil, fmt.Errorf("invalid packet length %d", caplen)
+    }
+
+    pkt, err := reader.readData(caplen)
+    if err != nil {
+        return nil, err
+    }
+    // padding and options
+    if _, err := reader.r.Discard(body - 20 - int(caplen)); err != nil {
+        pkt.Release()
+        return nil, errors.New("truncated enhanced packet block")
+    }
+    pkt.Time = iface.timestamp(ts)
+    pkt.Len = reader.order.Uint32(hdr[16:20])
+    pkt.LinkType = iface.linktype
+    reader.lasttime = pkt.Time
+    return pkt, nil
+}
+
+// readSimplePacket reads a SPB: always interface 0 and no timestamp,
+// so the packet gets the time of the previous one
+func (reader *FileReader) readSimplePacket(body int) (*Packet, error) {
+    if body < 4 {
+        return nil, errors.New("truncated simple packet block")
+    }
+    if len(reader.ifaces) == 0 {
+        return nil, errors.New("packet on undeclared interface 0")
+    }
+    iface := &reader.ifaces[0]
+    hdr := reader.hdr[:4]
+    if _, err := io.ReadFull(reader.r, hdr); err != nil {
+        return nil, errors.New("truncated simple packet block")
+    }
+    origlen := reader.order.Uint32(hdr[0:4])
+    caplen := uint32(body - 4)
+    if origlen < caplen {
+        caplen = origlen
+    }
+    if iface.snaplen != 0 && iface.snaplen < caplen {
+        caplen = iface.snaplen
+    }
+
+    pkt, err := reader.readData(caplen)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := reader.r.Discard(body - 4 - int(caplen)); err != nil {
+        pkt.Release()
+        return nil, errors.New("truncated simple packet block")
+    }
+    pkt.Time = reader.lasttime
+    pkt.Len = origlen
+    pkt.LinkType = iface.linktype
+    return pkt, nil
+}
+
+func (iface *ngInterface) timestamp(ts uint64) time.Time {
+    sec := ts / iface.tsunits
+    // rem < tsunits, so the division cannot overflow
+    hi, lo := bits.Mul64(ts%iface.tsunits, 1000000000)
+    nsec, _ := bits.Div64(hi, lo, iface.tsunits)
+    return time.Unix(int64(sec)+iface.tsoffset, int64(nsec))
+}
+
+// Datalink returns the link type of the file, or of the first pcapng interface
+func (reader *FileReader) Datalink() int {
+    if reader.ng {
+        if len(reader.ifaces) == 0 {
+            return -1
+        }
+        return reader.ifaces[0].linktype
+    }
+    return reader.linktype
+}
+
+// Stats counts the packets read so far, nothing is dropped in a file
+func (reader *FileReader) Stats() (*Stats, error) {
+    return &Stats{Received: reader.count}, nil
+}
+
+func (reader *FileReader) LinkType() int {
+    return reader.Datalink()
+}
+
+func (reader *FileReader) Geterror() error {
+    return reader.err
+}
+
+// Err is the read error which ended Next, nil at the end of the file
+func (reader *FileReader) Err() error {
+    return reader.err
+}
+
+// Breakloop makes Next return nil, from another goroutine
+func (reader *FileReader) Breakloop() {
+    atomic.StoreInt32(&reader.broken, 1)
+}
+
+func (reader *FileReader) Close() {
+    if reader.closer != nil {
+        reader.closer.Close()
+    }
+}
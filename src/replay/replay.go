@@ -0,0 +1,172 @@
+package replay
+
+/* send the packets of a capture on an interface, at the capture timing
+   or at a given rate */
+
+import (
+    "fmt"
+    "strconv"
+    "sync/atomic"
+    "time"
+
+    "capture"
+    "pcap"
+)
+
+const (
+    // longest sleep between two checks of Stop
+    REPLAY_SLEEP_MAX = 100 * time.Millisecond
+)
+
+// Injector sends frames: a libpcap handle or an AF_PACKET socket
+type Injector interface {
+    Inject(data []byte) error
+    Close()
+}
+
+type Options struct {
+    Speed   float64 // multiplier of the capture timing, 0 for top speed
+    Pps     float64 // fixed packets per second, instead of the timing
+    Mbps    float64 // fixed megabits per second, instead of the timing
+    Loop    int     // times the capture is sent, 0 for ever
+    Rewrite *Rewrite
+}
+
+// ParseOptions reads config["speed"], config["pps"], config["mbps"],
+// config["loop"] and config["rewrite"]
+func ParseOptions(config map[string]string) (*Options, error) {
+    opts := &Options{Speed: 1, Loop: 1}
+    for key, value := range map[string]*float64{
+        "speed": &opts.Speed,
+        "pps":   &opts.Pps,
+        "mbps":  &opts.Mbps,
+    } {
+        if config[key] == "" {
+            continue
+        }
+        parsed, err := strconv.ParseFloat(config[key], 64)
+        if err != nil || parsed < 0 {
+            return nil, fmt.Errorf("bad %s %q", key, config[key])
+        }
+        *value = parsed
+    }
+    if opts.Pps > 0 && opts.Mbps > 0 {
+        return nil, fmt.Errorf("pps and mbps cannot be both set")
+    }
+    if value := config["loop"]; value != "" {
+        loop, err := strconv.Atoi(value)
+        if err != nil || loop < 0 {
+            return nil, fmt.Errorf("bad loop %q", value)
+        }
+        opts.Loop = loop
+    }
+    rewrite, err := ParseRewrite(config["rewrite"])
+    if err != nil {
+        return nil, err
+    }
+    opts.Rewrite = rewrite
+    return opts, nil
+}
+
+// Replay sends captures through an Injector
+type Replay struct {
+    injector Injector
+    opts     *Options
+    stopped  int32
+
+    // atomic
+    Packets uint64
+    Bytes   uint64
+    Errors  uint64
+}
+
+func New(injector Injector, opts *Options) *Replay {
+    return &Replay{injector: injector, opts: opts}
+}
+
+// Stop ends Run after the current packet, from another goroutine
+func (replay *Replay) Stop() {
+    atomic.StoreInt32(&replay.stopped, 1)
+}
+
+func (replay *Replay) isStopped() bool {
+    return atomic.LoadInt32(&replay.stopped) != 0
+}
+
+// Run sends the capture given by open, opened again for each loop
+func (replay *Replay) Run(open func() (capture.PacketSource, error)) error {
+    for loop := 0; replay.opts.Loop == 0 || loop < replay.opts.Loop; loop++ {
+        source, err := open()
+        if err != nil {
+            return err
+        }
+        err = replay.send(source)
+        source.Close()
+        if err != nil || replay.isStopped() {
+            return err
+        }
+    }
+    return nil
+}
+
+// send injects the packets of one pass, each one at its offset from the
+// start of the pass
+func (replay *Replay) send(source capture.PacketSource) error {
+    opts := replay.opts
+    if opts.Rewrite != nil && source.LinkType() != pcap.LINKTYPE_ETHERNET {
+        return fmt.Errorf("link type %d: only Ethernet frames can be rewritten", source.LinkType())
+    }
+    start := time.Now()
+    var first time.Time
+    var offset time.Duration
+    for pkt := source.Next(); pkt != nil; pkt = source.Next() {
+        if replay.isStopped() {
+            pkt.Release()
+            return nil
+        }
+        var at time.Duration
+        switch {
+        case opts.Pps > 0:
+            at = offset
+            offset += time.Duration(float64(time.Second) / opts.Pps)
+        case opts.Mbps > 0:
+            at = offset
+            // the bytes sent, the captures may be truncated
+            offset += time.Duration(float64(len(pkt.Data)) * 8 / (opts.Mbps * 1e6) * float64(time.Second))
+        case opts.Speed > 0:
+            if first.IsZero() {
+                first = pkt.Time
+            }
+            at = time.Duration(float64(pkt.Time.Sub(first)) / opts.Speed)
+        }
+        replay.wait(start.Add(at))
+
+        opts.Rewrite.Apply(pkt.Data)
+        if err := replay.injector.Inject(pkt.Data); err != nil {
+            if atomic.AddUint64(&replay.Errors, 1) == 1 {
+                fmt.Printf("inject: %s\n", err)
+            }
+        } else {
+            atomic.AddUint64(&replay.Packets, 1)
+            atomic.AddUint64(&replay.Bytes, uint64(len(pkt.Data)))
+        }
+        pkt.Release()
+    }
+    return source.Err()
+}
+
+// wait sleeps until t; late packets go at once, the next ones catch up
+func (replay *Replay) wait(t time.Time) {
+    for wait := time.Until(t); wait > 0 && !replay.isStopped(); wait = time.Until(t) {
+        if wait > REPLAY_SLEEP_MAX {
+            wait = REPLAY_SLEEP_MAX
+        }
+        time.Sleep(wait)
+    }
+}
+
+func (replay *Replay) Show() string {
+    return fmt.Sprintf("sent=%d bytes=%d errors=%d",
+        atomic.LoadUint64(&replay.Packets), atomic.LoadUint64(&replay.Bytes),
+        atomic.LoadUint64(&replay.Errors))
+}
@@ -0,0 +1,133 @@
+package replay
+
+import (
+    "encoding/binary"
+    "fmt"
+    "net"
+    "strings"
+
+    "utils"
+)
+
+// Rewrite changes MAC and IPv4 addresses in Ethernet frames, fixing
+// the IPv4, TCP and UDP checksums
+type Rewrite struct {
+    macs map[uint64]uint64
+    ips  map[uint32]uint32
+}
+
+// ParseRewrite reads "old=new" pairs separated by commas, both MACs or
+// both IPv4 addresses; nil for an empty spec
+func ParseRewrite(spec string) (*Rewrite, error) {
+    if spec == "" {
+        return nil, nil
+    }
+    rewrite := &Rewrite{macs: make(map[uint64]uint64), ips: make(map[uint32]uint32)}
+    for _, pair := range strings.Split(spec, ",") {
+        from, to, ok := strings.Cut(pair, "=")
+        if !ok {
+            return nil, fmt.Errorf("bad rewrite %q: want old=new", pair)
+        }
+        if fromIp, toIp := net.ParseIP(from).To4(), net.ParseIP(to).To4(); fromIp != nil && toIp != nil {
+            rewrite.ips[binary.BigEndian.Uint32(fromIp)] = binary.BigEndian.Uint32(toIp)
+            continue
+        }
+        fromMac, err1 := net.ParseMAC(from)
+        toMac, err2 := net.ParseMAC(to)
+        if err1 != nil || err2 != nil || len(fromMac) != 6 || len(toMac) != 6 {
+            return nil, fmt.Errorf("bad rewrite %q: want two MACs or two IPv4 addresses", pair)
+        }
+        rewrite.macs[utils.DecodeMac(fromMac)] = utils.DecodeMac(toMac)
+    }
+    return rewrite, nil
+}
+
+// Apply rewrites an Ethernet frame in place; nil does nothing
+func (rewrite *Rewrite) Apply(data []byte) {
+    if rewrite == nil || len(data) < 14 {
+        return
+    }
+    if len(rewrite.macs) > 0 {
+        rewrite.mac(data[0:6])
+        rewrite.mac(data[6:12])
+    }
+    if len(rewrite.ips) == 0 {
+        return
+    }
+    offset := 12
+    for len(data) >= offset+2 {
+        ethertype := binary.BigEndian.Uint16(data[offset : offset+2])
+        if ethertype == 0x8100 || ethertype == 0x88A8 || ethertype == 0x9100 {
+            offset += 4
+            continue
+        }
+        if ethertype == 0x0800 {
+            rewrite.ipv4(data[offset+2:])
+        }
+        return
+    }
+}
+
+func (rewrite *Rewrite) mac(field []byte) {
+    if to, ok := rewrite.macs[utils.DecodeMac(field)]; ok {
+        for i := 5; i >= 0; i-- {
+            field[i] = byte(to)
+            to >>= 8
+        }
+    }
+}
+
+func (rewrite *Rewrite) ipv4(ip []byte) {
+    if len(ip) < 20 {
+        return
+    }
+    ihl := int(ip[0]&0x0F) * 4
+    if ihl < 20 || len(ip) < ihl {
+        return
+    }
+    // the TCP or UDP checksum, when the header is there: not in the
+    // next fragments
+    var l4sum []byte
+    udp := false
+    if binary.BigEndian.Uint16(ip[6:8])&0x1FFF == 0 {
+        switch ip[9] {
+        case 6:
+            if len(ip) >= ihl+18 {
+                l4sum = ip[ihl+16 : ihl+18]
+            }
+        case 17:
+            if len(ip) >= ihl+8 {
+                l4sum = ip[ihl+6 : ihl+8]
+                udp = true
+            }
+        }
+    }
+    for _, field := range [][]byte{ip[12:16], ip[16:20]} {
+        from := binary.BigEndian.Uint32(field)
+        to, ok := rewrite.ips[from]
+        if !ok {
+            continue
+        }
+        binary.BigEndian.PutUint32(field, to)
+        updateChecksum(ip[10:12], from, to)
+        // a zero UDP checksum means none
+        if l4sum != nil && !(udp && binary.BigEndian.Uint16(l4sum) == 0) {
+            updateChecksum(l4sum, from, to)
+            if udp && binary.BigEndian.Uint16(l4sum) == 0 {
+                binary.BigEndian.PutUint16(l4sum, 0xFFFF)
+            }
+        }
+    }
+}
+
+// updateChecksum changes a checksum for a 32 bit word going from old to
+// new, as in RFC 1624
+func updateChecksum(field []byte, from, to uint32) {
+    sum := uint32(^binary.BigEndian.Uint16(field))
+    sum += uint32(^uint16(from>>16)) + uint32(^uint16(from))
+    sum += uint32(uint16(to>>16)) + uint32(uint16(to))
+    for sum>>16 != 0 {
+        sum = sum&0xFFFF + sum>>16
+    }
+    binary.BigEndian.PutUint16(field, ^uint16(sum))
+}
@@ -1,6 +1,9 @@
 package utils
 
-import "fmt"
+import (
+    "fmt"
+    "time"
+)
 
 func MinInt(x int, y int) int {
     if x < y {
@@ -43,3 +46,11 @@ func EncodeIp(ip uint32) string {
         byte(ip),
     )
 }
+
+// EncodeTime gives seconds.nanoseconds, whatever the capture precision
+func EncodeTime(t time.Time) string {
+    if t.IsZero() {
+        return "0.000000000"
+    }
+    return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}